@@ -0,0 +1,109 @@
+package server
+
+import (
+	"bufio"
+	"io"
+)
+
+// asciiWriter converts the LF line endings of a stored file to the CRLF line endings
+// of the ASCII data representation (used by RETR in TYPE A)
+type asciiWriter struct {
+	w      io.Writer
+	lastCR bool // Whether the last byte written was a CR, so a following LF is already CRLF
+}
+
+func (a *asciiWriter) Write(p []byte) (int, error) {
+	start := 0
+	for i, c := range p {
+		if c == '\n' && !(i == 0 && a.lastCR) && !(i > 0 && p[i-1] == '\r') {
+			if _, err := a.w.Write(p[start:i]); err != nil {
+				return start, err
+			}
+			if _, err := a.w.Write([]byte("\r")); err != nil {
+				return i, err
+			}
+			start = i
+		}
+	}
+	if _, err := a.w.Write(p[start:]); err != nil {
+		return start, err
+	}
+	if len(p) > 0 {
+		a.lastCR = p[len(p)-1] == '\r'
+	}
+	return len(p), nil
+}
+
+// asciiReader converts the CRLF line endings of the ASCII data representation to the
+// LF line endings of stored files (used by STOR in TYPE A)
+type asciiReader struct {
+	r         *bufio.Reader
+	pendingCR bool // Whether a CR was read but not yet emitted, awaiting the next byte
+}
+
+func newASCIIReader(r io.Reader) *asciiReader {
+	return &asciiReader{r: bufio.NewReader(r)}
+}
+
+func (a *asciiReader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		c, err := a.r.ReadByte()
+		if err != nil {
+			// A trailing lone CR is kept as is
+			if a.pendingCR {
+				p[n] = '\r'
+				n++
+				a.pendingCR = false
+			}
+			if n > 0 {
+				return n, nil
+			}
+			return 0, err
+		}
+		if a.pendingCR {
+			a.pendingCR = false
+			if c != '\n' {
+				p[n] = '\r'
+				n++
+				if n == len(p) {
+					a.r.UnreadByte()
+					return n, nil
+				}
+			}
+		}
+		if c == '\r' {
+			a.pendingCR = true
+			continue
+		}
+		p[n] = c
+		n++
+		// Return what was converted so far rather than blocking on the connection
+		if a.r.Buffered() == 0 && !a.pendingCR {
+			return n, nil
+		}
+	}
+	return n, nil
+}
+
+// asciiSize returns the size of a stored file once converted to the ASCII representation
+func asciiSize(r io.Reader) (int64, error) {
+	var size int64
+	buf := make([]byte, 32*1024)
+	lastCR := false
+	for {
+		n, err := r.Read(buf)
+		for _, c := range buf[:n] {
+			size++
+			if c == '\n' && !lastCR {
+				size++
+			}
+			lastCR = c == '\r'
+		}
+		if err == io.EOF {
+			return size, nil
+		} else if err != nil {
+			return 0, err
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package auth
+
+import (
+	"crypto/md5"
+	"strings"
+)
+
+const apr1Magic = "$apr1$"
+
+// apr1Alphabet is the base64 variant used by crypt(3) hashes
+const apr1Alphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// apr1Crypt hashes `pass` with Apache's MD5 based crypt algorithm, using the salt of
+// `hash` (a complete "$apr1$salt$digest" string). The result is comparable to `hash`.
+func apr1Crypt(pass string, hash string) string {
+	salt := strings.TrimPrefix(hash, apr1Magic)
+	if i := strings.IndexByte(salt, '$'); i >= 0 {
+		salt = salt[:i]
+	}
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+
+	alternate := md5.Sum([]byte(pass + salt + pass))
+
+	ctx := md5.New()
+	ctx.Write([]byte(pass + apr1Magic + salt))
+	for i := len(pass); i > 0; i -= 16 {
+		if i > 16 {
+			ctx.Write(alternate[:])
+		} else {
+			ctx.Write(alternate[:i])
+		}
+	}
+	for i := len(pass); i > 0; i >>= 1 {
+		if i&1 == 1 {
+			ctx.Write([]byte{0})
+		} else {
+			ctx.Write([]byte{pass[0]})
+		}
+	}
+	final := ctx.Sum(nil)
+
+	// Deliberately slow the algorithm down with 1000 additional rounds
+	for i := 0; i < 1000; i++ {
+		round := md5.New()
+		if i&1 == 1 {
+			round.Write([]byte(pass))
+		} else {
+			round.Write(final)
+		}
+		if i%3 != 0 {
+			round.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			round.Write([]byte(pass))
+		}
+		if i&1 == 1 {
+			round.Write(final)
+		} else {
+			round.Write([]byte(pass))
+		}
+		final = round.Sum(nil)
+	}
+
+	// Encode the digest bytes in the permuted order defined by the algorithm
+	encoded := make([]byte, 0, 22)
+	encode := func(b2, b1, b0 byte, n int) {
+		v := uint(b2)<<16 | uint(b1)<<8 | uint(b0)
+		for ; n > 0; n-- {
+			encoded = append(encoded, apr1Alphabet[v&0x3f])
+			v >>= 6
+		}
+	}
+	encode(final[0], final[6], final[12], 4)
+	encode(final[1], final[7], final[13], 4)
+	encode(final[2], final[8], final[14], 4)
+	encode(final[3], final[9], final[15], 4)
+	encode(final[4], final[10], final[5], 4)
+	encode(0, 0, final[11], 2)
+
+	return apr1Magic + salt + "$" + string(encoded)
+}
@@ -0,0 +1,73 @@
+// Ready-made user authenticators to plug into a ServerDriver's AuthUser
+package auth
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/Charana123/ftp/server"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Authenticator checks the credentials of a user, with the same signature as
+// ServerDriver.AuthUser so that a driver can delegate to it directly
+type Authenticator interface {
+	AuthUser(ctx *server.UserContext, user string, pass string) (bool, error)
+}
+
+// Chain is an Authenticator trying each of its authenticators in order until one
+// accepts the credentials
+type Chain []Authenticator
+
+// AuthUser returns true as soon as an authenticator accepts the credentials. If none do,
+// the last error encountered (if any) is returned.
+func (c Chain) AuthUser(ctx *server.UserContext, user string, pass string) (bool, error) {
+	var lastErr error
+	for _, authenticator := range c {
+		ok, err := authenticator.AuthUser(ctx, user, pass)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if ok {
+			return true, nil
+		}
+	}
+	return false, lastErr
+}
+
+// verifyPassword checks `pass` against a hashed password in one of the formats
+// understood by Apache's htpasswd: bcrypt ("$2y$..."), APR1 MD5 ("$apr1$...") and
+// SHA-1 ("{SHA}..."). SHA-2 hashes ("{SHA256}...", "{SHA512}...") are also accepted.
+func verifyPassword(hash string, pass string) (bool, error) {
+	switch {
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+		err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(pass))
+		if err == bcrypt.ErrMismatchedHashAndPassword {
+			return false, nil
+		}
+		return err == nil, err
+	case strings.HasPrefix(hash, "$apr1$"):
+		return constantTimeEqual(hash, apr1Crypt(pass, hash)), nil
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(pass))
+		return constantTimeEqual(hash[len("{SHA}"):], base64.StdEncoding.EncodeToString(sum[:])), nil
+	case strings.HasPrefix(hash, "{SHA256}"):
+		sum := sha256.Sum256([]byte(pass))
+		return constantTimeEqual(hash[len("{SHA256}"):], base64.StdEncoding.EncodeToString(sum[:])), nil
+	case strings.HasPrefix(hash, "{SHA512}"):
+		sum := sha512.Sum512([]byte(pass))
+		return constantTimeEqual(hash[len("{SHA512}"):], base64.StdEncoding.EncodeToString(sum[:])), nil
+	default:
+		return false, fmt.Errorf("unsupported password hash format")
+	}
+}
+
+func constantTimeEqual(a string, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
@@ -0,0 +1,200 @@
+package auth_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/Charana123/ftp/server"
+	"github.com/Charana123/ftp/server/auth"
+)
+
+// htpasswd holds one user per hash format, as written by `htpasswd -m`, `-s` and `-B`
+// (`openssl passwd -apr1` for the APR1 vectors)
+const htpasswd = `# comment
+apache:$apr1$r31.....$HqJZimcKQFAMYayBlzkrA/
+empty:$apr1$abcdefgh$L.PT565ESX4Tp2bqNs7Ie.
+long:$apr1$x$eVg/QpGhpgNiDA46nGsav0
+sha:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=
+sha256:{SHA256}K7gNU3sdo+OL0wNhqoVWhr3g6s1xYv72ol/pe/Unols=
+sha512:{SHA512}vSsar3708Jvp9Szi2NWZZ02Bqp1qRCFpbcTZPdBhnWgs5WtNZKnvCXdhztmeD2cmW192CF5bDufKRpayrW/isg==
+bcrypt:$2y$05$NTvIbk7QTeOFynJ64QQuPusKRA7RLxirADAED5t0lmi2lXiD3Z3bm
+
+crypt:rl0dVYC7yd9yA
+`
+
+func writeFile(t *testing.T, name string, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestHtpasswdFormats(t *testing.T) {
+	h, err := auth.NewHtpasswdFile(writeFile(t, "htpasswd", htpasswd))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		user, pass string
+		success    bool
+	}{
+		{"apache", "myPassword", true},
+		{"apache", "mypassword", false},
+		{"empty", "", true},
+		{"empty", "x", false},
+		{"long", "a much longer password than sixteen bytes", true},
+		{"long", "a much longer password than sixteen byte", false},
+		{"sha", "secret", true},
+		{"sha", "Secret", false},
+		{"sha256", "secret", true},
+		{"sha256", "secret ", false},
+		{"sha512", "secret", true},
+		{"sha512", "", false},
+		{"bcrypt", "secret", true},
+		{"bcrypt", "wrong", false},
+		{"missing", "secret", false},
+		{"# comment", "", false},
+	} {
+		success, err := h.AuthUser(&server.UserContext{}, test.user, test.pass)
+		if err != nil {
+			t.Errorf("AuthUser(%q, %q): %v", test.user, test.pass, err)
+		}
+		if success != test.success {
+			t.Errorf("AuthUser(%q, %q) = %v, want %v", test.user, test.pass, success, test.success)
+		}
+	}
+	// DES crypt is not understood by htpasswd on every platform
+	if success, err := h.AuthUser(&server.UserContext{}, "crypt", "secret"); err == nil || success {
+		t.Errorf("AuthUser(crypt) = %v, %v, want an error", success, err)
+	}
+}
+
+func TestHtpasswdReload(t *testing.T) {
+	path := writeFile(t, "htpasswd", "sha:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n")
+	h, err := auth.NewHtpasswdFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if success, _ := h.AuthUser(&server.UserContext{}, "sha", "secret"); !success {
+		t.Fatal("AuthUser before reload failed")
+	}
+	if err := ioutil.WriteFile(path, []byte(htpasswd), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if success, _ := h.AuthUser(&server.UserContext{}, "apache", "myPassword"); !success {
+		t.Error("user added to the file was not loaded")
+	}
+
+	// A missing file fails the login rather than serving stale users
+	os.Remove(path)
+	if success, err := h.AuthUser(&server.UserContext{}, "apache", "myPassword"); err == nil || success {
+		t.Errorf("AuthUser with the file missing = %v, %v, want an error", success, err)
+	}
+	if _, err := auth.NewHtpasswdFile(path); err == nil {
+		t.Error("NewHtpasswdFile of a missing file succeeded")
+	}
+}
+
+func TestUserTable(t *testing.T) {
+	table, err := auth.LoadUserTable(writeFile(t, "users.json", `{
+		"alice": {
+			"password": "{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=",
+			"home": "/srv/ftp/alice",
+			"groups": ["staff"],
+			"permissions": ["/srv/ftp/alice/"]
+		},
+		"bob": {"password": "$apr1$r31.....$HqJZimcKQFAMYayBlzkrA/"}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := &server.UserContext{CWD: "/srv/ftp"}
+	if success, err := table.AuthUser(ctx, "alice", "wrong"); err != nil || success {
+		t.Errorf("AuthUser(alice, wrong) = %v, %v", success, err)
+	}
+	if ctx.CWD != "/srv/ftp" || ctx.Groups != nil || ctx.Permissions != nil {
+		t.Errorf("failed login changed the context: %+v", ctx)
+	}
+	if success, err := table.AuthUser(ctx, "alice", "secret"); err != nil || !success {
+		t.Fatalf("AuthUser(alice) = %v, %v", success, err)
+	}
+	if ctx.CWD != "/srv/ftp/alice" {
+		t.Errorf("CWD = %q", ctx.CWD)
+	}
+	if !reflect.DeepEqual(ctx.Groups, []string{"staff"}) || !reflect.DeepEqual(ctx.Permissions, []string{"/srv/ftp/alice/"}) {
+		t.Errorf("Groups = %v, Permissions = %v", ctx.Groups, ctx.Permissions)
+	}
+	// Users without a home directory keep the current one
+	ctx = &server.UserContext{CWD: "/srv/ftp"}
+	if success, err := table.AuthUser(ctx, "bob", "myPassword"); err != nil || !success || ctx.CWD != "/srv/ftp" {
+		t.Errorf("AuthUser(bob) = %v, %v, CWD = %q", success, err, ctx.CWD)
+	}
+	if success, err := table.AuthUser(ctx, "carol", "secret"); err != nil || success {
+		t.Errorf("AuthUser(carol) = %v, %v", success, err)
+	}
+
+	if _, err := auth.LoadUserTable(writeFile(t, "broken.json", "{")); err == nil {
+		t.Error("LoadUserTable of invalid JSON succeeded")
+	}
+}
+
+// authenticatorFunc adapts a function to the Authenticator interface
+type authenticatorFunc func(user string, pass string) (bool, error)
+
+func (f authenticatorFunc) AuthUser(ctx *server.UserContext, user string, pass string) (bool, error) {
+	return f(user, pass)
+}
+
+func TestChain(t *testing.T) {
+	unavailable := errors.New("unavailable")
+	var tried []string
+	authenticator := func(name string, users map[string]string, err error) auth.Authenticator {
+		return authenticatorFunc(func(user string, pass string) (bool, error) {
+			tried = append(tried, name)
+			if err != nil {
+				return false, err
+			}
+			return users[user] == pass && pass != "", nil
+		})
+	}
+	chain := auth.Chain{
+		authenticator("first", map[string]string{"alice": "one"}, nil),
+		authenticator("broken", nil, unavailable),
+		authenticator("last", map[string]string{"alice": "two", "bob": "three"}, nil),
+	}
+	for _, test := range []struct {
+		user, pass string
+		success    bool
+		err        error
+		tried      []string
+	}{
+		// The first authenticator accepting the credentials ends the chain
+		{"alice", "one", true, nil, []string{"first"}},
+		// Rejections and errors fall through to the next authenticator
+		{"alice", "two", true, nil, []string{"first", "broken", "last"}},
+		{"bob", "three", true, nil, []string{"first", "broken", "last"}},
+		// When none accept, the error of the failing authenticator is returned
+		{"bob", "one", false, unavailable, []string{"first", "broken", "last"}},
+	} {
+		tried = nil
+		success, err := chain.AuthUser(&server.UserContext{}, test.user, test.pass)
+		if success != test.success || err != test.err || !reflect.DeepEqual(tried, test.tried) {
+			t.Errorf("AuthUser(%q, %q) = %v, %v after trying %v, want %v, %v after %v",
+				test.user, test.pass, success, err, tried, test.success, test.err, test.tried)
+		}
+	}
+
+	if success, err := (auth.Chain{chain[0], chain[2]}).AuthUser(&server.UserContext{}, "carol", "x"); success || err != nil {
+		t.Errorf("AuthUser(carol) = %v, %v, want false without an error", success, err)
+	}
+	if success, err := (auth.Chain{}).AuthUser(&server.UserContext{}, "alice", "one"); success || err != nil {
+		t.Errorf("empty chain AuthUser = %v, %v", success, err)
+	}
+}
@@ -0,0 +1,95 @@
+package auth
+
+import (
+	"bufio"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Charana123/ftp/server"
+)
+
+// HtpasswdFile authenticates users against an Apache htpasswd file. The file is
+// reloaded whenever its modification time or size changes.
+type HtpasswdFile struct {
+	path    string
+	lock    sync.RWMutex
+	hashes  map[string]string
+	modTime time.Time
+	size    int64
+}
+
+// NewHtpasswdFile loads the htpasswd file at `path`
+func NewHtpasswdFile(path string) (*HtpasswdFile, error) {
+	h := &HtpasswdFile{path: path}
+	if err := h.reloadIfChanged(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// AuthUser checks the password of `user` against its hash in the htpasswd file
+func (h *HtpasswdFile) AuthUser(ctx *server.UserContext, user string, pass string) (bool, error) {
+	if err := h.reloadIfChanged(); err != nil {
+		return false, err
+	}
+	h.lock.RLock()
+	hash, ok := h.hashes[user]
+	h.lock.RUnlock()
+	if !ok {
+		return false, nil
+	}
+	return verifyPassword(hash, pass)
+}
+
+// reloadIfChanged parses the htpasswd file again if it changed since it was last loaded.
+// On error the previously loaded users are kept.
+func (h *HtpasswdFile) reloadIfChanged() error {
+	info, err := os.Stat(h.path)
+	if err != nil {
+		return err
+	}
+	h.lock.RLock()
+	unchanged := h.hashes != nil && info.ModTime().Equal(h.modTime) && info.Size() == h.size
+	h.lock.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	hashes, err := parseHtpasswd(h.path)
+	if err != nil {
+		return err
+	}
+	h.lock.Lock()
+	h.hashes = hashes
+	h.modTime = info.ModTime()
+	h.size = info.Size()
+	h.lock.Unlock()
+	return nil
+}
+
+// parseHtpasswd reads the `user:hash` lines of an htpasswd file, skipping blank lines
+// and comments
+func parseHtpasswd(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	hashes := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		fields := strings.SplitN(line, ":", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		hashes[fields[0]] = fields[1]
+	}
+	return hashes, scanner.Err()
+}
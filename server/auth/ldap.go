@@ -0,0 +1,280 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Charana123/ftp/server"
+	"github.com/go-ldap/ldap/v3"
+)
+
+// ErrInvalidCredentials is returned by LDAPConn.Bind when the DN or password is wrong
+var ErrInvalidCredentials = errors.New("ldap: invalid credentials")
+
+// LDAPEntry is a directory entry returned by LDAPConn.Search
+type LDAPEntry struct {
+	DN         string
+	Attributes map[string][]string
+}
+
+// LDAPConn is the subset of an LDAP client connection used by LDAPAuthenticator.
+// Supplying your own (see the ldaptest package) allows testing without a directory server.
+type LDAPConn interface {
+	StartTLS(config *tls.Config) error
+	Bind(dn string, password string) error
+	Search(baseDN string, filter string, attributes []string) ([]*LDAPEntry, error)
+	Close()
+}
+
+// LDAPConfig configures an LDAPAuthenticator
+type LDAPConfig struct {
+	// Address of the directory, e.g. "ldap://ldap.example.com:389" or "ldaps://..."
+	URL string
+	// Upgrade plain ldap:// connections to TLS before binding
+	StartTLS bool
+	// TLS configuration used for ldaps:// and StartTLS
+	TLSConfig *tls.Config
+	// Service account used to search for users, anonymous search if empty
+	BindDN       string
+	BindPassword string
+	// Subtree searched for users
+	BaseDN string
+	// Filter locating a user, with `%s` replaced by the escaped username, e.g. "(uid=%s)"
+	UserFilter string
+	// Attribute of the user entry listing its groups, e.g. "memberOf"
+	GroupAttribute string
+	// Maps LDAP group DNs to FTP groups. When nil, the first RDN value of each group
+	// DN is used (e.g. "cn=staff,ou=groups,dc=example,dc=com" becomes "staff").
+	GroupMapping map[string]string
+	// How long a successful login is remembered, no caching if zero
+	CacheTTL time.Duration
+	// Opens connections to the directory, defaults to dialing URL
+	Dial func() (LDAPConn, error)
+}
+
+// LDAPAuthenticator authenticates users against an LDAP directory by searching for the
+// user's entry with a service account and then binding as that entry
+type LDAPAuthenticator struct {
+	config     LDAPConfig
+	cacheLock  sync.Mutex
+	cache      map[string]*ldapCacheEntry
+	attributes []string
+}
+
+// ldapCacheEntry remembers a successful login
+type ldapCacheEntry struct {
+	passHash [sha256.Size]byte
+	groups   []string
+	expires  time.Time
+}
+
+// NewLDAPAuthenticator validates `config` and creates an LDAPAuthenticator
+func NewLDAPAuthenticator(config LDAPConfig) (*LDAPAuthenticator, error) {
+	if config.BaseDN == "" {
+		return nil, fmt.Errorf("ldap: base DN required")
+	}
+	if !strings.Contains(config.UserFilter, "%s") {
+		return nil, fmt.Errorf("ldap: user filter %q has no %%s placeholder", config.UserFilter)
+	}
+	if config.Dial == nil {
+		if config.URL == "" {
+			return nil, fmt.Errorf("ldap: URL required")
+		}
+		config.Dial = func() (LDAPConn, error) {
+			return dialLDAP(config.URL, config.TLSConfig)
+		}
+	}
+	// "1.1" requests no attributes at all (RFC 4511)
+	attributes := []string{"1.1"}
+	if config.GroupAttribute != "" {
+		attributes = []string{config.GroupAttribute}
+	}
+	return &LDAPAuthenticator{
+		config:     config,
+		cache:      make(map[string]*ldapCacheEntry),
+		attributes: attributes,
+	}, nil
+}
+
+// AuthUser authenticates `user` against the directory and, on success, applies the FTP
+// groups mapped from the user's LDAP groups to the connection
+func (a *LDAPAuthenticator) AuthUser(ctx *server.UserContext, user string, pass string) (bool, error) {
+	// An empty password would make the bind anonymous, which always succeeds
+	if user == "" || pass == "" {
+		return false, nil
+	}
+	passHash := sha256.Sum256([]byte(user + "\x00" + pass))
+	if groups, ok := a.cached(user, passHash); ok {
+		ctx.Groups = groups
+		return true, nil
+	}
+
+	groups, ok, err := a.authenticate(user, pass)
+	if err != nil || !ok {
+		return false, err
+	}
+	if a.config.CacheTTL > 0 {
+		a.cacheLock.Lock()
+		a.cache[user] = &ldapCacheEntry{
+			passHash: passHash,
+			groups:   groups,
+			expires:  time.Now().Add(a.config.CacheTTL),
+		}
+		a.cacheLock.Unlock()
+	}
+	ctx.Groups = append([]string{}, groups...)
+	return true, nil
+}
+
+// cached returns the groups of a cached successful login with the same password
+func (a *LDAPAuthenticator) cached(user string, passHash [sha256.Size]byte) ([]string, bool) {
+	a.cacheLock.Lock()
+	defer a.cacheLock.Unlock()
+	entry, ok := a.cache[user]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(entry.expires) {
+		delete(a.cache, user)
+		return nil, false
+	}
+	if entry.passHash != passHash {
+		return nil, false
+	}
+	return append([]string{}, entry.groups...), true
+}
+
+// FlushCache forgets all cached logins, e.g. after a password or group change
+func (a *LDAPAuthenticator) FlushCache() {
+	a.cacheLock.Lock()
+	a.cache = make(map[string]*ldapCacheEntry)
+	a.cacheLock.Unlock()
+}
+
+// authenticate performs the search-then-bind and returns the FTP groups of the user
+func (a *LDAPAuthenticator) authenticate(user string, pass string) ([]string, bool, error) {
+	conn, err := a.config.Dial()
+	if err != nil {
+		return nil, false, err
+	}
+	defer conn.Close()
+
+	if a.config.StartTLS {
+		if err := conn.StartTLS(a.config.TLSConfig); err != nil {
+			return nil, false, err
+		}
+	}
+	if a.config.BindDN != "" {
+		if err := conn.Bind(a.config.BindDN, a.config.BindPassword); err != nil {
+			return nil, false, fmt.Errorf("ldap: service account bind failed: %v", err)
+		}
+	}
+
+	filter := fmt.Sprintf(a.config.UserFilter, escapeFilter(user))
+	entries, err := conn.Search(a.config.BaseDN, filter, a.attributes)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(entries) != 1 {
+		// Unknown user, or a filter ambiguous enough to match several
+		return nil, false, nil
+	}
+
+	err = conn.Bind(entries[0].DN, pass)
+	if err == ErrInvalidCredentials {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+	return a.mapGroups(entries[0].Attributes[a.config.GroupAttribute]), true, nil
+}
+
+// mapGroups translates LDAP group DNs to FTP groups
+func (a *LDAPAuthenticator) mapGroups(groupDNs []string) []string {
+	groups := make([]string, 0, len(groupDNs))
+	for _, dn := range groupDNs {
+		if a.config.GroupMapping != nil {
+			if group, ok := a.config.GroupMapping[dn]; ok {
+				groups = append(groups, group)
+			}
+			continue
+		}
+		rdn := strings.SplitN(dn, ",", 2)[0]
+		if i := strings.IndexByte(rdn, '='); i >= 0 {
+			rdn = rdn[i+1:]
+		}
+		groups = append(groups, rdn)
+	}
+	return groups
+}
+
+// escapeFilter escapes the special characters of an LDAP filter value (RFC 4515)
+func escapeFilter(value string) string {
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		switch c := value[i]; c {
+		case '*', '(', ')', '\\', 0:
+			fmt.Fprintf(&b, "\\%02x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// ldapClient adapts a go-ldap connection to LDAPConn
+type ldapClient struct {
+	conn *ldap.Conn
+}
+
+func dialLDAP(url string, tlsConfig *tls.Config) (LDAPConn, error) {
+	conn, err := ldap.DialURL(url, ldap.DialWithTLSConfig(tlsConfig))
+	if err != nil {
+		return nil, err
+	}
+	return &ldapClient{conn: conn}, nil
+}
+
+func (c *ldapClient) StartTLS(config *tls.Config) error {
+	return c.conn.StartTLS(config)
+}
+
+func (c *ldapClient) Bind(dn string, password string) error {
+	err := c.conn.Bind(dn, password)
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+		return ErrInvalidCredentials
+	}
+	return err
+}
+
+func (c *ldapClient) Search(baseDN string, filter string, attributes []string) ([]*LDAPEntry, error) {
+	// Two entries are enough to tell that a filter is ambiguous
+	request := ldap.NewSearchRequest(baseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
+		2, 0, false, filter, attributes, nil)
+	result, err := c.conn.Search(request)
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) && result != nil && len(result.Entries) > 1 {
+		// Returning the entries found so far lets LDAPAuthenticator reject the ambiguous match
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]*LDAPEntry, 0, len(result.Entries))
+	for _, e := range result.Entries {
+		entry := &LDAPEntry{DN: e.DN, Attributes: make(map[string][]string)}
+		for _, attribute := range e.Attributes {
+			entry.Attributes[attribute.Name] = attribute.Values
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func (c *ldapClient) Close() {
+	c.conn.Close()
+}
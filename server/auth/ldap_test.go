@@ -0,0 +1,189 @@
+package auth_test
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Charana123/ftp/server"
+	"github.com/Charana123/ftp/server/auth"
+	"github.com/Charana123/ftp/server/auth/ldaptest"
+)
+
+// newDirectory returns a directory holding a service account and the users alice and bob
+func newDirectory() *ldaptest.Directory {
+	directory := ldaptest.NewDirectory()
+	directory.AddEntry("cn=ftp,dc=example,dc=com", "service", nil)
+	directory.AddEntry("uid=alice,ou=people,dc=example,dc=com", "secret", map[string][]string{
+		"uid":      {"alice"},
+		"memberOf": {"cn=staff,ou=groups,dc=example,dc=com", "cn=admins,ou=groups,dc=example,dc=com"},
+	})
+	directory.AddEntry("uid=bob,ou=people,dc=example,dc=com", "hunter2", map[string][]string{
+		"uid": {"bob"},
+	})
+	return directory
+}
+
+func newAuthenticator(t *testing.T, directory *ldaptest.Directory, configure func(*auth.LDAPConfig)) *auth.LDAPAuthenticator {
+	config := auth.LDAPConfig{
+		BindDN:         "cn=ftp,dc=example,dc=com",
+		BindPassword:   "service",
+		BaseDN:         "dc=example,dc=com",
+		UserFilter:     "(uid=%s)",
+		GroupAttribute: "memberOf",
+		Dial:           directory.Dial,
+	}
+	if configure != nil {
+		configure(&config)
+	}
+	authenticator, err := auth.NewLDAPAuthenticator(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return authenticator
+}
+
+func TestLDAPBind(t *testing.T) {
+	authenticator := newAuthenticator(t, newDirectory(), nil)
+	for _, test := range []struct {
+		user, pass string
+		success    bool
+	}{
+		{"alice", "secret", true},
+		{"alice", "wrong", false},
+		{"alice", "", false},
+		{"bob", "secret", false},
+		{"carol", "secret", false},
+		{"*", "secret", false},
+	} {
+		ctx := &server.UserContext{}
+		success, err := authenticator.AuthUser(ctx, test.user, test.pass)
+		if err != nil {
+			t.Errorf("AuthUser(%q, %q): %v", test.user, test.pass, err)
+		}
+		if success != test.success {
+			t.Errorf("AuthUser(%q, %q) = %v, want %v", test.user, test.pass, success, test.success)
+		}
+	}
+}
+
+func TestLDAPSearchThenBind(t *testing.T) {
+	directory := newDirectory()
+	authenticator := newAuthenticator(t, directory, nil)
+	ctx := &server.UserContext{}
+	if success, err := authenticator.AuthUser(ctx, "alice", "secret"); err != nil || !success {
+		t.Fatalf("AuthUser = %v, %v", success, err)
+	}
+	// The service account searches, then the entry found binds
+	if directory.Binds != 2 {
+		t.Errorf("Binds = %d, want 2", directory.Binds)
+	}
+	if want := []string{"staff", "admins"}; !reflect.DeepEqual(ctx.Groups, want) {
+		t.Errorf("Groups = %v, want %v", ctx.Groups, want)
+	}
+
+	// Users found nowhere never bind
+	if success, err := authenticator.AuthUser(ctx, "carol", "secret"); err != nil || success {
+		t.Errorf("AuthUser(carol) = %v, %v", success, err)
+	}
+	if directory.Binds != 3 {
+		t.Errorf("Binds = %d, want 3", directory.Binds)
+	}
+
+	// Neither do users matching several entries
+	directory.AddEntry("uid=alice,ou=contractors,dc=example,dc=com", "secret", map[string][]string{
+		"uid": {"alice"},
+	})
+	if success, err := authenticator.AuthUser(ctx, "alice", "secret"); err != nil || success {
+		t.Errorf("AuthUser(ambiguous alice) = %v, %v", success, err)
+	}
+	if directory.Binds != 4 {
+		t.Errorf("Binds = %d, want 4", directory.Binds)
+	}
+}
+
+func TestLDAPServiceAccountFailure(t *testing.T) {
+	authenticator := newAuthenticator(t, newDirectory(), func(config *auth.LDAPConfig) {
+		config.BindPassword = "wrong"
+	})
+	if success, err := authenticator.AuthUser(&server.UserContext{}, "alice", "secret"); err == nil || success {
+		t.Errorf("AuthUser = %v, %v, want an error", success, err)
+	}
+}
+
+func TestLDAPGroupMapping(t *testing.T) {
+	authenticator := newAuthenticator(t, newDirectory(), func(config *auth.LDAPConfig) {
+		config.GroupMapping = map[string]string{"cn=admins,ou=groups,dc=example,dc=com": "ftpadmin"}
+	})
+	ctx := &server.UserContext{}
+	if success, err := authenticator.AuthUser(ctx, "alice", "secret"); err != nil || !success {
+		t.Fatalf("AuthUser = %v, %v", success, err)
+	}
+	if want := []string{"ftpadmin"}; !reflect.DeepEqual(ctx.Groups, want) {
+		t.Errorf("Groups = %v, want %v", ctx.Groups, want)
+	}
+}
+
+func TestLDAPStartTLS(t *testing.T) {
+	directory := newDirectory()
+	directory.RequireStartTLS = true
+
+	plain := newAuthenticator(t, directory, nil)
+	if success, err := plain.AuthUser(&server.UserContext{}, "alice", "secret"); err == nil || success {
+		t.Errorf("AuthUser without StartTLS = %v, %v, want an error", success, err)
+	}
+
+	upgraded := newAuthenticator(t, directory, func(config *auth.LDAPConfig) {
+		config.StartTLS = true
+	})
+	if success, err := upgraded.AuthUser(&server.UserContext{}, "alice", "secret"); err != nil || !success {
+		t.Errorf("AuthUser with StartTLS = %v, %v", success, err)
+	}
+}
+
+func TestLDAPCache(t *testing.T) {
+	directory := newDirectory()
+	authenticator := newAuthenticator(t, directory, func(config *auth.LDAPConfig) {
+		config.CacheTTL = time.Minute
+	})
+	login := func(pass string) bool {
+		ctx := &server.UserContext{}
+		success, err := authenticator.AuthUser(ctx, "alice", pass)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if success && len(ctx.Groups) != 2 {
+			t.Errorf("Groups = %v", ctx.Groups)
+		}
+		return success
+	}
+
+	if !login("secret") || directory.Binds != 2 {
+		t.Fatalf("first login: Binds = %d", directory.Binds)
+	}
+	// Served from the cache
+	if !login("secret") || directory.Binds != 2 {
+		t.Errorf("cached login: Binds = %d, want 2", directory.Binds)
+	}
+	// Other passwords are checked against the directory
+	if login("wrong") || directory.Binds != 4 {
+		t.Errorf("wrong password: Binds = %d, want 4", directory.Binds)
+	}
+	authenticator.FlushCache()
+	if !login("secret") || directory.Binds != 6 {
+		t.Errorf("login after flush: Binds = %d, want 6", directory.Binds)
+	}
+}
+
+func TestNewLDAPAuthenticator(t *testing.T) {
+	directory := newDirectory()
+	for _, config := range []auth.LDAPConfig{
+		{UserFilter: "(uid=%s)", Dial: directory.Dial},
+		{BaseDN: "dc=example,dc=com", UserFilter: "(uid=alice)", Dial: directory.Dial},
+		{BaseDN: "dc=example,dc=com", UserFilter: "(uid=%s)"},
+	} {
+		if _, err := auth.NewLDAPAuthenticator(config); err == nil {
+			t.Errorf("NewLDAPAuthenticator(%+v) succeeded", config)
+		}
+	}
+}
@@ -0,0 +1,239 @@
+// In-process LDAP directory stub for exercising auth.LDAPAuthenticator without a server
+package ldaptest
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/Charana123/ftp/server/auth"
+)
+
+// Directory is an in-memory LDAP directory. Plug it into an LDAPAuthenticator with
+// `auth.LDAPConfig{Dial: directory.Dial, ...}`.
+type Directory struct {
+	lock    sync.RWMutex
+	entries map[string]*entry
+
+	// Binds counts the bind operations performed, to observe caching
+	Binds int
+	// RequireStartTLS makes every operation fail until StartTLS has been called
+	RequireStartTLS bool
+}
+
+type entry struct {
+	dn         string
+	password   string
+	attributes map[string][]string
+}
+
+// NewDirectory creates an empty directory
+func NewDirectory() *Directory {
+	return &Directory{entries: make(map[string]*entry)}
+}
+
+// AddEntry adds (or replaces) an entry. An empty password makes the entry unbindable.
+func (d *Directory) AddEntry(dn string, password string, attributes map[string][]string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	lowered := make(map[string][]string)
+	for name, values := range attributes {
+		lowered[strings.ToLower(name)] = values
+	}
+	d.entries[strings.ToLower(dn)] = &entry{dn: dn, password: password, attributes: lowered}
+}
+
+// Dial opens a connection to the directory
+func (d *Directory) Dial() (auth.LDAPConn, error) {
+	return &conn{directory: d}, nil
+}
+
+// conn is a connection to a Directory
+type conn struct {
+	directory *Directory
+	tls       bool
+	closed    bool
+}
+
+func (c *conn) check() error {
+	if c.closed {
+		return fmt.Errorf("ldaptest: connection closed")
+	}
+	if c.directory.RequireStartTLS && !c.tls {
+		return fmt.Errorf("ldaptest: confidentiality required")
+	}
+	return nil
+}
+
+func (c *conn) StartTLS(config *tls.Config) error {
+	if c.tls {
+		return fmt.Errorf("ldaptest: TLS already started")
+	}
+	c.tls = true
+	return nil
+}
+
+func (c *conn) Bind(dn string, password string) error {
+	if err := c.check(); err != nil {
+		return err
+	}
+	c.directory.lock.Lock()
+	defer c.directory.lock.Unlock()
+	c.directory.Binds++
+	e, ok := c.directory.entries[strings.ToLower(dn)]
+	if !ok || e.password == "" || e.password != password {
+		return auth.ErrInvalidCredentials
+	}
+	return nil
+}
+
+func (c *conn) Search(baseDN string, filter string, attributes []string) ([]*auth.LDAPEntry, error) {
+	if err := c.check(); err != nil {
+		return nil, err
+	}
+	f, rest, err := parseFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	if rest != "" {
+		return nil, fmt.Errorf("ldaptest: trailing characters in filter %q", filter)
+	}
+
+	c.directory.lock.RLock()
+	defer c.directory.lock.RUnlock()
+	base := strings.ToLower(baseDN)
+	results := make([]*auth.LDAPEntry, 0)
+	for key, e := range c.directory.entries {
+		if key != base && !strings.HasSuffix(key, ","+base) {
+			continue
+		}
+		if !f(e) {
+			continue
+		}
+		result := &auth.LDAPEntry{DN: e.dn, Attributes: make(map[string][]string)}
+		for _, name := range attributes {
+			if values, ok := e.attributes[strings.ToLower(name)]; ok {
+				result.Attributes[name] = values
+			}
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+func (c *conn) Close() {
+	c.closed = true
+}
+
+// matcher reports whether an entry matches a filter
+type matcher func(e *entry) bool
+
+// parseFilter parses the leading filter of `s` (RFC 4515) supporting the `&`, `|` and `!`
+// operators, equality, presence (`attr=*`) and substring (`attr=a*b`) matches
+func parseFilter(s string) (matcher, string, error) {
+	if len(s) < 2 || s[0] != '(' {
+		return nil, "", fmt.Errorf("ldaptest: invalid filter %q", s)
+	}
+	switch s[1] {
+	case '&', '|':
+		and := s[1] == '&'
+		rest := s[2:]
+		subs := make([]matcher, 0)
+		for len(rest) > 0 && rest[0] == '(' {
+			sub, r, err := parseFilter(rest)
+			if err != nil {
+				return nil, "", err
+			}
+			subs = append(subs, sub)
+			rest = r
+		}
+		if len(rest) == 0 || rest[0] != ')' {
+			return nil, "", fmt.Errorf("ldaptest: unterminated filter %q", s)
+		}
+		return func(e *entry) bool {
+			for _, sub := range subs {
+				if sub(e) != and {
+					return !and
+				}
+			}
+			return and
+		}, rest[1:], nil
+	case '!':
+		sub, rest, err := parseFilter(s[2:])
+		if err != nil {
+			return nil, "", err
+		}
+		if len(rest) == 0 || rest[0] != ')' {
+			return nil, "", fmt.Errorf("ldaptest: unterminated filter %q", s)
+		}
+		return func(e *entry) bool { return !sub(e) }, rest[1:], nil
+	}
+
+	end := strings.IndexByte(s, ')')
+	if end < 0 {
+		return nil, "", fmt.Errorf("ldaptest: unterminated filter %q", s)
+	}
+	item := strings.SplitN(s[1:end], "=", 2)
+	if len(item) != 2 {
+		return nil, "", fmt.Errorf("ldaptest: invalid filter %q", s)
+	}
+	name := strings.ToLower(item[0])
+	pattern := strings.Split(item[1], "*")
+	for i := range pattern {
+		unescaped, err := unescape(pattern[i])
+		if err != nil {
+			return nil, "", err
+		}
+		pattern[i] = strings.ToLower(unescaped)
+	}
+	return func(e *entry) bool {
+		for _, value := range e.attributes[name] {
+			if matchPattern(strings.ToLower(value), pattern) {
+				return true
+			}
+		}
+		return false
+	}, s[end+1:], nil
+}
+
+// matchPattern matches a value against the `*` separated parts of a substring filter
+func matchPattern(value string, parts []string) bool {
+	if len(parts) == 1 {
+		return value == parts[0]
+	}
+	if !strings.HasPrefix(value, parts[0]) {
+		return false
+	}
+	value = value[len(parts[0]):]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(value, part)
+		if i < 0 {
+			return false
+		}
+		value = value[i+len(part):]
+	}
+	return strings.HasSuffix(value, parts[len(parts)-1])
+}
+
+// unescape decodes the `\xx` escapes of a filter value
+func unescape(s string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b.WriteByte(s[i])
+			continue
+		}
+		if i+2 >= len(s) {
+			return "", fmt.Errorf("ldaptest: invalid escape in %q", s)
+		}
+		c, err := strconv.ParseUint(s[i+1:i+3], 16, 8)
+		if err != nil {
+			return "", fmt.Errorf("ldaptest: invalid escape in %q", s)
+		}
+		b.WriteByte(byte(c))
+		i += 2
+	}
+	return b.String(), nil
+}
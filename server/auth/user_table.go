@@ -0,0 +1,70 @@
+package auth
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/Charana123/ftp/server"
+	"gopkg.in/yaml.v3"
+)
+
+// User is an entry of a UserTable
+type User struct {
+	// Hashed password, in any format understood by htpasswd (bcrypt, APR1 MD5, SHA)
+	Password string `json:"password" yaml:"password"`
+	// Initial working directory of the user
+	Home string `json:"home" yaml:"home"`
+	// Groups of the user, selecting the "@group" access control rules
+	Groups []string `json:"groups" yaml:"groups"`
+	// Access control rules granted to the user alone
+	Permissions []string `json:"permissions" yaml:"permissions"`
+}
+
+// UserTable authenticates users against a static table of users keyed by username
+type UserTable map[string]*User
+
+// LoadUserTable reads a user table from a YAML (.yaml, .yml) or JSON file, e.g.
+//
+//	alice:
+//	  password: "$2y$10$..."
+//	  home: /srv/ftp/alice
+//	  groups: [staff]
+//	  permissions: [/srv/ftp/alice/]
+func LoadUserTable(path string) (UserTable, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	table := make(UserTable)
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(buf, &table)
+	default:
+		err = json.Unmarshal(buf, &table)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return table, nil
+}
+
+// AuthUser checks the password of `user` and, on success, applies the home directory,
+// groups and permissions of the user to the connection
+func (t UserTable) AuthUser(ctx *server.UserContext, user string, pass string) (bool, error) {
+	entry, ok := t[user]
+	if !ok {
+		return false, nil
+	}
+	ok, err := verifyPassword(entry.Password, pass)
+	if err != nil || !ok {
+		return false, err
+	}
+	if entry.Home != "" {
+		ctx.CWD = entry.Home
+	}
+	ctx.Groups = append([]string{}, entry.Groups...)
+	ctx.Permissions = append([]string{}, entry.Permissions...)
+	return true, nil
+}
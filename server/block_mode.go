@@ -0,0 +1,165 @@
+package server
+
+import (
+	"io"
+	"strconv"
+)
+
+// Block mode (MODE B, RFC 959 section 3.4.2) descriptor codes
+const (
+	blockEOR     = 128 // End of data block is EOR
+	blockEOF     = 64  // End of data block is EOF
+	blockRestart = 16  // Data block is a restart marker
+	// Largest byte count of a block, encoded in 16 bits
+	maxBlockSize = 65535
+)
+
+// blockWriter frames data into MODE B blocks
+type blockWriter struct {
+	w io.Writer
+}
+
+func (b *blockWriter) writeBlock(descriptor byte, data []byte) error {
+	header := []byte{descriptor, byte(len(data) >> 8), byte(len(data))}
+	if _, err := b.w.Write(header); err != nil {
+		return err
+	}
+	_, err := b.w.Write(data)
+	return err
+}
+
+func (b *blockWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := len(p)
+		if n > maxBlockSize {
+			n = maxBlockSize
+		}
+		if err := b.writeBlock(0, p[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Close ends the file with an empty EOF block, leaving the data connection open
+func (b *blockWriter) Close() error {
+	return b.writeBlock(blockEOF, nil)
+}
+
+// markerWriter sends a restart marker through a blockWriter every `interval` bytes of the
+// stored file written to `w`, holding the offset in the file of the data sent so far, which
+// the user can later give to REST to resume the transfer from that point. Counting file
+// bytes before `w` converts them (TYPE A) keeps markers and REST offsets consistent.
+type markerWriter struct {
+	w           io.Writer // Writes to `blocks`, after any conversion
+	blocks      *blockWriter
+	offset      int64 // Offset in the file of the next byte, including any REST offset
+	interval    int64 // File bytes between restart markers
+	sinceMarker int64
+}
+
+func (m *markerWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if m.sinceMarker >= m.interval {
+			if err := m.blocks.writeBlock(blockRestart, []byte(strconv.FormatInt(m.offset, 10))); err != nil {
+				return written, err
+			}
+			m.sinceMarker = 0
+		}
+		n := len(p)
+		if int64(n) > m.interval-m.sinceMarker {
+			n = int(m.interval - m.sinceMarker)
+		}
+		n, err := m.w.Write(p[:n])
+		m.offset += int64(n)
+		m.sinceMarker += int64(n)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// blockReader extracts the data of MODE B blocks until the EOF block. Restart markers sent
+// by the user are passed to `onMarker` with the offset in the stored file of the data
+// received up to them.
+type blockReader struct {
+	r         io.Reader
+	offset    int64 // Offset in the stored file of the next data byte, including any REST offset
+	ascii     bool  // Whether the data is in the ASCII representation, stored with LF line endings
+	lastCR    bool  // Whether the last data byte was a CR, which a following LF is stored in place of
+	remaining int   // Data bytes left in the current block
+	eof       bool  // Whether the current block is the last one
+	onMarker  func(marker string, offset int64)
+}
+
+func (b *blockReader) Read(p []byte) (int, error) {
+	for b.remaining == 0 {
+		if b.eof {
+			return 0, io.EOF
+		}
+		header := make([]byte, 3)
+		if _, err := io.ReadFull(b.r, header); err != nil {
+			// The connection must not close before the EOF block
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		descriptor, count := header[0], int(header[1])<<8|int(header[2])
+		if descriptor&blockRestart != 0 {
+			marker := make([]byte, count)
+			if _, err := io.ReadFull(b.r, marker); err != nil {
+				return 0, io.ErrUnexpectedEOF
+			}
+			if b.onMarker != nil {
+				// A CR just received is only stored once the next byte shows it is not a CRLF
+				offset := b.offset
+				if b.lastCR {
+					offset--
+				}
+				b.onMarker(string(marker), offset)
+			}
+			continue
+		}
+		b.remaining = count
+		b.eof = descriptor&blockEOF != 0
+	}
+	if len(p) > b.remaining {
+		p = p[:b.remaining]
+	}
+	n, err := b.r.Read(p)
+	b.remaining -= n
+	if b.ascii {
+		// Each CRLF is stored as a single LF
+		for _, c := range p[:n] {
+			if c != '\n' || !b.lastCR {
+				b.offset++
+			}
+			b.lastCR = c == '\r'
+		}
+	} else {
+		b.offset += int64(n)
+	}
+	if err == io.EOF {
+		if b.remaining > 0 {
+			return n, io.ErrUnexpectedEOF
+		}
+		err = nil
+	}
+	return n, err
+}
+
+// blockRestartInterval returns how many bytes are sent between restart markers in MODE B
+func blockRestartInterval() int64 {
+	if globalServerSettings.BlockRestartInterval > 0 {
+		return globalServerSettings.BlockRestartInterval
+	}
+	return 1024 * 1024
+}
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"strings"
+)
+
+// CertAuthMode selects how a verified TLS client certificate authenticates a connection.
+// Client certificates must be requested and verified through the tls.Config returned by
+// ServerDriver.GetTLSConfig (e.g. with ClientAuth set to tls.RequireAndVerifyClientCert).
+type CertAuthMode int
+
+const (
+	// CertAuthNone ignores client certificates
+	CertAuthNone CertAuthMode = iota
+	// CertAuthMatchUser still requires USER and PASS, but USER must be the certificate
+	// identity. Connections without a certificate identifying a user cannot log in.
+	CertAuthMatchUser
+	// CertAuthLogin logs the certificate identity in without USER and PASS
+	CertAuthLogin
+)
+
+// CertIdentity selects the field of a client certificate naming the FTP user
+type CertIdentity int
+
+const (
+	// CertIdentityCommonName uses the subject common name
+	CertIdentityCommonName CertIdentity = iota
+	// CertIdentityEmail uses the first email address subject alternative name
+	CertIdentityEmail
+	// CertIdentityDNSName uses the first DNS name subject alternative name
+	CertIdentityDNSName
+)
+
+// CertAuthSettings configures client certificate authentication
+type CertAuthSettings struct {
+	Mode CertAuthMode
+	// Certificate field naming the user, unless Fingerprints is set
+	Identity CertIdentity
+	// Maps hex encoded SHA-256 fingerprints of client certificates (colons optional)
+	// to usernames. When set, only the listed certificates identify users.
+	Fingerprints map[string]string
+}
+
+// CertAuthDriver is optionally implemented by a ServerDriver to approve logins made with a
+// client certificate (CertAuthLogin), as AuthUser does for password logins
+type CertAuthDriver interface {
+	AuthCert(ctx *UserContext, user string, chain []*x509.Certificate) (bool, error)
+}
+
+// certificateFingerprint returns the lower case hex SHA-256 fingerprint of a certificate
+func certificateFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// certificateUser returns the username identified by a verified client certificate,
+// or "" if it identifies no one
+func certificateUser(cert *x509.Certificate, settings CertAuthSettings) string {
+	if len(settings.Fingerprints) > 0 {
+		fingerprint := certificateFingerprint(cert)
+		for f, user := range settings.Fingerprints {
+			if strings.ToLower(strings.Replace(f, ":", "", -1)) == fingerprint {
+				return user
+			}
+		}
+		return ""
+	}
+	switch settings.Identity {
+	case CertIdentityEmail:
+		if len(cert.EmailAddresses) > 0 {
+			return cert.EmailAddresses[0]
+		}
+	case CertIdentityDNSName:
+		if len(cert.DNSNames) > 0 {
+			return cert.DNSNames[0]
+		}
+	default:
+		return cert.Subject.CommonName
+	}
+	return ""
+}
+
+// identifyClientCertificate records the verified certificate chain of the TLS control
+// connection in the UserContext and the user it identifies
+func (conn *ftpConnection) identifyClientCertificate() {
+	state := conn.tlsConn.ConnectionState()
+	// Only certificates verified against the configured client CAs are trusted
+	if len(state.VerifiedChains) == 0 {
+		return
+	}
+	conn.ctx.PeerCertificates = state.VerifiedChains[0]
+	if globalServerSettings.CertAuth.Mode != CertAuthNone {
+		conn.certUser = certificateUser(state.VerifiedChains[0][0], globalServerSettings.CertAuth)
+	}
+}
+
+// certLogin logs in the user identified by the client certificate when certificates
+// alone authenticate connections
+func (conn *ftpConnection) certLogin() {
+	if conn.certUser == "" || globalServerSettings.CertAuth.Mode != CertAuthLogin {
+		return
+	}
+	ip := conn.remoteIP()
+	// Certificates do not bypass bans earned with failed password logins
+	if loginBanned(ip, conn.certUser) {
+		return
+	}
+	if !loginAllowed(ip, conn.certUser) {
+		emitEvent(Event{
+			Kind:     EventLoginRejected,
+			RemoteIP: ip,
+			User:     conn.certUser,
+			Message:  "Certificate login of " + conn.certUser + " from " + ip + " refused by IP filter",
+			Session:  conn.ctx,
+		})
+		return
+	}
+	if certAuthDriver, ok := globalDriver.(CertAuthDriver); ok {
+		success, err := certAuthDriver.AuthCert(conn.ctx, conn.certUser, conn.ctx.PeerCertificates)
+		if err != nil || !success {
+			return
+		}
+	}
+	conn.ctx.User = conn.certUser
+	if !conn.loadUserStorage() {
+		conn.resetLogin()
+		return
+	}
+	conn.login(ip)
+}
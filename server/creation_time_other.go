@@ -0,0 +1,17 @@
+//go:build !windows
+// +build !windows
+
+package server
+
+import (
+	"errors"
+	"time"
+)
+
+// creationTimeSupported tells whether MFCT can set file creation times on this platform
+const creationTimeSupported = false
+
+// setCreationTime is unsupported where the creation time cannot be set by applications
+func setCreationTime(path string, t time.Time) error {
+	return errors.New("setting the creation time is not supported on this platform")
+}
@@ -0,0 +1,27 @@
+package server
+
+import (
+	"syscall"
+	"time"
+)
+
+// creationTimeSupported tells whether MFCT can set file creation times on this platform
+const creationTimeSupported = true
+
+// setCreationTime sets the creation time of a file or directory
+func setCreationTime(path string, t time.Time) error {
+	pathPtr, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return err
+	}
+	// FILE_FLAG_BACKUP_SEMANTICS allows opening directories
+	handle, err := syscall.CreateFile(pathPtr, syscall.FILE_WRITE_ATTRIBUTES,
+		syscall.FILE_SHARE_READ|syscall.FILE_SHARE_WRITE, nil, syscall.OPEN_EXISTING,
+		syscall.FILE_FLAG_BACKUP_SEMANTICS, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.CloseHandle(handle)
+	creationTime := syscall.NsecToFiletime(t.UnixNano())
+	return syscall.SetFileTime(handle, &creationTime, nil, nil)
+}
@@ -17,7 +17,8 @@ type ServerDriver interface {
 	// GetSettings returns a set of updated server configuration parameters
 	GetSettings() (*ServerSettings, error)
 	// GetAccessControlSettings returns a set of access control rules enforced on
-	// most FTP service request
+	// most FTP service request. Rules are keyed by "all", by username or by group
+	// name prefixed with "@", and list the files and directories (ending in "/") allowed.
 	GetAccessControlSettings() (map[string][]string, error)
 	// GetTLSConfig returns a tls config with atleast one tls certificate
 	GetTLSConfig() (*tls.Config, error)
@@ -26,12 +27,70 @@ type ServerDriver interface {
 type ServerSettings struct {
 	// Public FTP directory whose access is unrestricted to authenticated users
 	PublicDirectory string
+	// Filesystem holding the served files, the local filesystem if nil. Drivers implementing
+	// MountDriver may give each user a MountTable of their own instead.
+	Storage Storage
 	// Port listening to control connections
 	ListeningPort int
 	// Public Address of FTP host
 	PublicIP string
 	// Port range on which data connections will be established (PASV)
 	DataPortRange *PortRange
+	// Throughput shared by all connections, adjustable at runtime with SetGlobalRateLimits
+	GlobalRateLimits RateLimits
+	// Default throughput of each connection, adjustable at runtime with UserContext.SetRateLimits
+	SessionRateLimits RateLimits
+	// Maximum number of simultaneous control connections (0 for unlimited)
+	MaxConnections int
+	// Maximum number of simultaneous control connections from a single IP (0 for unlimited)
+	MaxConnectionsPerIP int
+	// Maximum number of simultaneous logins of a single user (0 for unlimited)
+	MaxLoginsPerUser int
+	// Message sent with the 421 reply when one of the above limits is exceeded
+	ConnectionLimitMessage string
+	// Protection against password guessing
+	LoginThrottle LoginThrottleSettings
+	// Source IPs allowed to connect, replaceable at runtime with SetIPFilter
+	IPFilter *IPFilter
+	// Source IPs allowed to log in per username, replaceable at runtime with SetUserIPFilters
+	UserIPFilters map[string]*IPFilter
+	// Allows data connections with hosts other than the user's (server to server transfers).
+	// Disabled by default as it exposes the server to FTP bounce attacks.
+	AllowFXP bool
+	// Authentication of users with verified TLS client certificates
+	CertAuth CertAuthSettings
+	// Format of LIST replies, Unix `ls -l` style by default
+	ListFormat ListFormat
+	// Owner and group names shown in Unix style listings ("ftp" if empty)
+	ListOwner string
+	ListGroup string
+	// Shows the numeric owner and group IDs of files in Unix style listings instead
+	ListShowOwner bool
+	// Levels of subdirectories descended into by recursive listings (LIST -R), 8 if zero
+	ListMaxDepth int
+	// Replies 550 to SIZE in ASCII mode rather than reading the whole file to compute it
+	RefuseASCIISize bool
+	// Enables deflate compressed transfers (MODE Z)
+	ModeZ bool
+	// Highest compression level clients may request with OPTS MODE Z LEVEL (1-9), 9 if zero
+	ModeZMaxLevel int
+	// Bytes sent between restart markers in block mode (MODE B), 1 MiB if zero
+	BlockRestartInterval int64
+	// Number of file hashes (HASH, XMD5, ...) remembered until the file changes, none if zero
+	HashCacheSize int
+	// Where the SHA-256 hash computed while storing each file is recorded, besides the
+	// upload-complete event
+	UploadHashStore UploadHashStore
+	// Directory receiving uploads that fail SITE VERIFY, ".quarantine" in the upload directory if
+	// empty. Users are refused access to it.
+	QuarantineDirectory string
+}
+
+// RateLimitDriver is optionally implemented by a ServerDriver to throttle transfers per user
+type RateLimitDriver interface {
+	// GetUserRateLimits returns the throughput shared by all connections of the user
+	// that has just logged in
+	GetUserRateLimits(ctx *UserContext) (RateLimits, error)
 }
 
 type PortRange struct {
@@ -3,33 +3,28 @@ package driver
 import (
 	"crypto/tls"
 	"fmt"
-	"sync/atomic"
 
 	"github.com/Charana123/ftp/server"
 	"github.com/Charana123/ftp/utils"
 )
 
 type ExampleDriver struct {
-	MaxConnections int32
-	numClients     int32
+	MaxConnections int
 }
 
 func (d *ExampleDriver) Welcome(ctx *server.UserContext) (string, error) {
-	if atomic.AddInt32(&d.numClients, 1) > d.MaxConnections {
-		return "", fmt.Errorf("Maximum number of connections %d reached", d.MaxConnections)
-	}
+	// Connection limits are enforced by the server (see ServerSettings.MaxConnections)
 	return fmt.Sprintf("Welcome"), nil
 }
 
 func (d *ExampleDriver) Bye(ctx *server.UserContext) (string, error) {
-	atomic.AddInt32(&d.numClients, -1)
 	return fmt.Sprintf("Bye"), nil
 }
 
 func (d *ExampleDriver) AuthUser(ctx *server.UserContext, user string, pass string) (bool, error) {
 	// No authentication.
-	// You would most likely parse a local configuration file here that contains a set of
-	// privledged users and match the username and password provided here against them.
+	// You would most likely delegate to one of the authenticators of the `auth` package here,
+	// e.g. an `auth.HtpasswdFile` or an `auth.UserTable` loaded from a local configuration file.
 	return true, nil
 }
 
@@ -52,11 +47,14 @@ func (d *ExampleDriver) GetSettings() (*server.ServerSettings, error) {
 	if err != nil {
 		return nil, err
 	}
+	// Files are served from the local filesystem unless `Storage` is set, e.g. to an
+	// in-memory `memfs.FS` in tests or an S3 bucket with `s3fs.New`
 	return &server.ServerSettings{
 		ListeningPort:   2121,
 		PublicIP:        publicIP,
 		PublicDirectory: "/Users/charana/Documents/ftp-public/",
 		DataPortRange:   dataPortRange,
+		MaxConnections:  d.MaxConnections,
 	}, nil
 }
 
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"log"
+	"time"
+)
+
+// EventKind identifies what happened in an Event
+type EventKind string
+
+const (
+	// EventLoginBan fires when an IP or username is temporarily banned after failed logins
+	EventLoginBan EventKind = "login-ban"
+	// EventConnectionRejected fires when a connection is refused by the server IP filter
+	EventConnectionRejected EventKind = "connection-rejected"
+	// EventLoginRejected fires when a login is refused by the IP filter of the user
+	EventLoginRejected EventKind = "login-rejected"
+	// EventUploadComplete fires when a file has been stored, along with its SHA-256 hash
+	EventUploadComplete EventKind = "upload-complete"
+	// EventUploadQuarantined fires when a stored file does not match the hash asserted with
+	// SITE VERIFY and is moved to quarantine
+	EventUploadQuarantined EventKind = "upload-quarantined"
+)
+
+// Event describes something noteworthy that happened on the server
+type Event struct {
+	Kind     EventKind
+	Time     time.Time
+	RemoteIP string       // Source IP of the connection involved, if any
+	User     string       // Username involved, if any
+	Message  string       // Human readable description
+	Path     string       // File involved, if any
+	Size     int64        // Size of the file involved, if any
+	Hash     string       // Hexadecimal SHA-256 hash of the file involved, if any
+	Session  *UserContext // Context of the connection involved, if any
+}
+
+// EventDriver is optionally implemented by a ServerDriver to be notified of server events
+type EventDriver interface {
+	// HandleEvent is called synchronously, so long running work should be done asynchronously
+	HandleEvent(event Event)
+}
+
+// emitEvent logs an event and forwards it to the driver if it supports events
+func emitEvent(event Event) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	log.Println("event " + string(event.Kind) + ": " + event.Message)
+	if eventDriver, ok := globalDriver.(EventDriver); ok {
+		eventDriver.HandleEvent(event)
+	}
+}
@@ -0,0 +1,80 @@
+package server
+
+import (
+	"container/list"
+	"os"
+	"sync"
+	"time"
+)
+
+// fileCache remembers values computed from the contents of files, such as ASCII sizes or
+// hashes, as long as the files keep the same modification time and size. The least
+// recently used values are evicted once the capacity is reached.
+type fileCache struct {
+	lock     sync.Mutex
+	capacity int                      // Number of values remembered, none if zero
+	entries  map[string]*list.Element // Elements of `order` by key
+	order    *list.List               // Cached values, most recently used first
+}
+
+// fileCacheEntry is a value computed from a file as long as the file is unchanged
+type fileCacheEntry struct {
+	key     string
+	modTime time.Time
+	size    int64
+	value   interface{}
+}
+
+// globalASCIISizes caches the size of files once converted to CRLF line endings
+var globalASCIISizes = newFileCache(1024)
+
+// newFileCache creates a fileCache holding up to `capacity` values
+func newFileCache(capacity int) *fileCache {
+	return &fileCache{
+		capacity: capacity,
+		entries:  make(map[string]*list.Element),
+		order:    list.New(),
+	}
+}
+
+// get returns the value cached under `key` if the file described by `info` has not been
+// modified since
+func (c *fileCache) get(key string, info os.FileInfo) (interface{}, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	element, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := element.Value.(*fileCacheEntry)
+	if !entry.modTime.Equal(info.ModTime()) || entry.size != info.Size() {
+		c.order.Remove(element)
+		delete(c.entries, key)
+		return nil, false
+	}
+	c.order.MoveToFront(element)
+	return entry.value, true
+}
+
+// put caches a value computed from the file described by `info` under `key`
+func (c *fileCache) put(key string, info os.FileInfo, value interface{}) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.capacity <= 0 {
+		return
+	}
+	if element, ok := c.entries[key]; ok {
+		c.order.Remove(element)
+	}
+	c.entries[key] = c.order.PushFront(&fileCacheEntry{
+		key:     key,
+		modTime: info.ModTime(),
+		size:    info.Size(),
+		value:   value,
+	})
+	if c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*fileCacheEntry).key)
+	}
+}
@@ -2,6 +2,9 @@ package server
 
 import (
 	"strings"
+	"time"
+
+	"github.com/Charana123/ftp/utils"
 )
 
 // user handles a user 'USER' control command
@@ -10,6 +13,20 @@ func (conn *ftpConnection) user(args []string) {
 		conn.sendReply(500, "Syntax error, command unrecognized.")
 		return
 	}
+	if conn.certUser != "" || globalServerSettings.CertAuth.Mode == CertAuthMatchUser {
+		// The user must be the one identified by the client certificate, which
+		// connections without one identifying a user cannot match
+		if conn.certUser == "" || args[0] != conn.certUser {
+			conn.sendReply(530, "Not logged in.")
+			return
+		}
+		if conn.loggedIn && conn.loginUser == conn.certUser {
+			conn.sendReply(232, "User logged in, authorized by security data exchange.")
+			return
+		}
+	}
+	// A new USER ends the session of the user logged in (RFC 959)
+	conn.resetLogin()
 	conn.ctx.User = args[0]
 	conn.sendReply(331, "User name okay, need password.")
 }
@@ -20,36 +37,115 @@ func (conn *ftpConnection) pass(args []string) {
 		conn.sendReply(500, "Syntax error, command unrecognized.")
 		return
 	}
+	// Handling when the user already logged in with a client certificate
+	if conn.loggedIn && conn.certUser != "" && conn.loginUser == conn.certUser {
+		conn.sendReply(202, "Command not implemented, superfluous at this site.")
+		return
+	}
 	// Handling when the password is sent before the username
 	if conn.ctx.User == "" {
 		conn.sendReply(503, "Bad sequence of commands.")
+		return
+	}
+	ip := conn.remoteIP()
+	if loginBanned(ip, conn.ctx.User) {
+		conn.resetLogin()
+		conn.sendReply(530, "Not logged in.")
+		return
+	}
+	if !loginAllowed(ip, conn.ctx.User) {
+		emitEvent(Event{
+			Kind:     EventLoginRejected,
+			RemoteIP: ip,
+			User:     conn.ctx.User,
+			Message:  "Login of " + conn.ctx.User + " from " + ip + " refused by IP filter",
+			Session:  conn.ctx,
+		})
+		conn.resetLogin()
+		conn.sendReply(530, "Not logged in.")
+		return
 	}
 	success, err := globalDriver.AuthUser(conn.ctx, conn.ctx.User, args[0])
 	if err != nil || !success {
-		conn.ctx.User = ""
+		time.Sleep(conn.loginFailed(ip, conn.ctx.User))
+		conn.resetLogin()
 		conn.sendReply(530, "Not logged in.")
-	} else {
-		conn.loggedIn = true
+		conn.failedLogins++
+		if max := globalServerSettings.LoginThrottle.MaxFailuresPerSession; max > 0 && conn.failedLogins >= max {
+			conn.sendReply(421, "Too many failed logins, closing control connection.")
+			conn.control.Close()
+		}
+	} else if !conn.loadUserStorage() {
+		conn.resetLogin()
+		conn.sendReply(530, "Not logged in.")
+	} else if conn.login(ip) {
 		conn.sendReply(230, "User logged in, proceed.")
 	}
 }
 
+// login logs in the user of the connection once authenticated, returning false (after
+// closing the connection) if the user has too many concurrent logins
+func (conn *ftpConnection) login(ip string) bool {
+	// Logging in again releases the login slot held by the previous user
+	conn.logout()
+	if !acquireLogin(conn.ctx.User) {
+		conn.resetLogin()
+		conn.sendReply(421, connectionLimitMessage())
+		conn.control.Close()
+		return false
+	}
+	loginSucceeded(ip, conn.ctx.User)
+	conn.loginUser = conn.ctx.User
+	conn.loggedIn = true
+	utils.HandleWarning(nil, conn.applyUserRateLimits())
+	return true
+}
+
+// resetLogin logs the user out and forgets the user name along with everything granted to
+// it, so that nothing carries over to the next login
+func (conn *ftpConnection) resetLogin() {
+	conn.logout()
+	conn.ctx.User = ""
+	// Authenticators may have moved the user to its home directory
+	conn.ctx.CWD = globalServerSettings.PublicDirectory
+	conn.ctx.Groups = nil
+	conn.ctx.Permissions = nil
+	conn.userStorage = nil
+}
+
 // checkAccessControl checks global and per user access control permissions
 // to allow an FTP service command
 func (conn *ftpConnection) checkAccessControl(path string) bool {
-	if all, ok := globalAccessControlSettings["all"]; ok {
-		for _, p := range all {
-			// If `p` is a path to a directory
-			if p[len(p)-1] == '/' {
-				// Check if `path` IS the directory or is a file (or directory) IN that directory
-				if strings.HasPrefix(path, p) || strings.Compare(path, p[:len(p)-1]) == 0 {
-					return true
-				}
-			} else {
-				// Check if `path` IS that file
-				if strings.Compare(path, p) == 0 {
-					return true
-				}
+	// Quarantined uploads are kept from users whatever the rules
+	if inQuarantine(path) {
+		return false
+	}
+	// Rules granted to all users, to the user, to each group of the user
+	// and to this connection alone all apply
+	rules := make([]string, 0)
+	rules = append(rules, globalAccessControlSettings["all"]...)
+	if conn.loginUser != "" {
+		rules = append(rules, globalAccessControlSettings[conn.loginUser]...)
+	}
+	for _, group := range conn.ctx.Groups {
+		rules = append(rules, globalAccessControlSettings["@"+group]...)
+	}
+	rules = append(rules, conn.ctx.Permissions...)
+
+	for _, p := range rules {
+		if p == "" {
+			continue
+		}
+		// If `p` is a path to a directory
+		if p[len(p)-1] == '/' {
+			// Check if `path` IS the directory or is a file (or directory) IN that directory
+			if strings.HasPrefix(path, p) || strings.Compare(path, p[:len(p)-1]) == 0 {
+				return true
+			}
+		} else {
+			// Check if `path` IS that file
+			if strings.Compare(path, p) == 0 {
+				return true
 			}
 		}
 	}
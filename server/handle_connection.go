@@ -1,7 +1,9 @@
 package server
 
 import (
+	"crypto/tls"
 	"fmt"
+	"log"
 	"net"
 	"strconv"
 	"strings"
@@ -20,12 +22,15 @@ var (
 )
 
 // getFreeListenerPort synchronized go routine access when obtaining a free listener port
-func getFreeListenerPort() int {
+func getFreeListenerPort() (int, error) {
 	globalLock.Lock()
+	defer globalLock.Unlock()
+	if len(freeListenerPorts) == 0 {
+		return 0, fmt.Errorf("No free port to listen for data connections")
+	}
 	freeListenerPort := freeListenerPorts[len(freeListenerPorts)-1]
 	freeListenerPorts = freeListenerPorts[:len(freeListenerPorts)-1]
-	globalLock.Unlock()
-	return freeListenerPort
+	return freeListenerPort, nil
 }
 
 // putFreeListenerPort synchronized go routine access when putting back
@@ -37,23 +42,31 @@ func putFreeListenerPort(port int) {
 
 // pasv handles a user 'PASV' control command
 func (conn *ftpConnection) pasv() {
+	conn.discardDataConnection()
 
 	// Transition to a `passive` mode from `active` mode
 	if !conn.isPasv {
 		var pasvDataListener net.Listener
-		conn.isPasv = true
 		for pasvDataListener == nil {
-			port := getFreeListenerPort()
+			port, err := getFreeListenerPort()
+			if notok := utils.HandleWarning(func() {
+				conn.sendReply(425, "Can't open data connection.")
+			}, err); notok {
+				return
+			}
 			conn.pasvPort = port
 			pasvDataListener, _ = net.Listen("tcp4", ":"+strconv.Itoa(port))
 		}
+		conn.isPasv = true
 		conn.pasvDataListener = pasvDataListener
+		conn.pasvData = make(chan net.Conn, 1)
+		// Asynchronously listen to incoming data connections from the user.
+		// Allowing the server to handle incoming control commands without blocking here.
+		go conn.acceptPassive(pasvDataListener, conn.pasvData)
+	} else {
+		// A connection made after an earlier PASV is not the one for the next transfer
+		discardPassive(conn.pasvData)
 	}
-	// Asynchronously listen to incoming data connections from the user.
-	// Allowing the server to handle incoming control commands without blocking here.
-	go func() {
-		conn.data, _ = conn.pasvDataListener.Accept()
-	}()
 
 	// Depending on wether the incoming connection came from an IP address internal/external
 	// to the LAN we return either our local IP or our global IP.
@@ -72,18 +85,62 @@ func (conn *ftpConnection) pasv() {
 	conn.sendReply(227, "Entering Passive Mode "+pasvAddr)
 }
 
-// port handles a user 'PORT' control command
-func (conn *ftpConnection) port(argument string) {
-	// Transition from `passive` mode to `active` mode
-	if conn.isPasv {
-		conn.isPasv = false
-		conn.pasvDataListener.Close()
-		// Recycles the now unused passive data connection port
-		putFreeListenerPort(conn.pasvPort)
+// acceptPassive accepts the data connections made to a passive mode listener until it is
+// closed, handing them over to openDataConnection one at a time
+func (conn *ftpConnection) acceptPassive(listener net.Listener, accepted chan<- net.Conn) {
+	for {
+		data, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		// Connections from any host other than the user could steal the transfer
+		if !conn.dataPeerAllowed(data.RemoteAddr().(*net.TCPAddr).IP) {
+			log.Println("Refusing passive data connection from " + data.RemoteAddr().String() +
+				" for control connection " + conn.control.RemoteAddr().String())
+			data.Close()
+			continue
+		}
+		select {
+		case accepted <- data:
+		default:
+			// A connection is already waiting for the next transfer
+			data.Close()
+		}
+	}
+}
+
+// closePassive stops listening for passive data connections and recycles the port
+func (conn *ftpConnection) closePassive() {
+	if !conn.isPasv {
+		return
+	}
+	conn.isPasv = false
+	conn.pasvDataListener.Close()
+	discardPassive(conn.pasvData)
+	putFreeListenerPort(conn.pasvPort)
+}
+
+// discardPassive closes any passive data connection accepted but not yet used
+func discardPassive(accepted chan net.Conn) {
+	select {
+	case data := <-accepted:
+		data.Close()
+	default:
 	}
+}
 
+// port handles a user 'PORT' control command
+func (conn *ftpConnection) port(args []string) {
 	// Parse and validate user end-point (TCP address)
-	byteFields := strings.Split(argument, ",")
+	if len(args) == 0 {
+		conn.sendReply(501, "Syntax error in parameters or arguments.")
+		return
+	}
+	byteFields := strings.Split(args[0], ",")
+	if len(byteFields) != 6 {
+		conn.sendReply(501, "Syntax error in parameters or arguments.")
+		return
+	}
 	high, err1 := strconv.Atoi(byteFields[4])
 	low, err2 := strconv.Atoi(byteFields[5])
 	port := high*256 + low
@@ -93,32 +150,169 @@ func (conn *ftpConnection) port(argument string) {
 	}, err1, err2, err3); notok {
 		return
 	}
+	conn.setActiveAddr(activeAddr)
+}
+
+// eprt handles a user 'EPRT' control command (RFC 2428), e.g. `EPRT |2|::1|6275|`
+func (conn *ftpConnection) eprt(args []string) {
+	if len(args) == 0 || len(args[0]) < 2 {
+		conn.sendReply(501, "Syntax error in parameters or arguments.")
+		return
+	}
+	delimiter := args[0][0:1]
+	fields := strings.Split(args[0], delimiter)
+	if len(fields) != 5 {
+		conn.sendReply(501, "Syntax error in parameters or arguments.")
+		return
+	}
+	var network string
+	switch fields[1] {
+	case "1":
+		network = "tcp4"
+	case "2":
+		network = "tcp6"
+	default:
+		conn.sendReply(522, "Network protocol not supported, use (1,2)")
+		return
+	}
+	activeAddr, err := net.ResolveTCPAddr(network, net.JoinHostPort(fields[2], fields[3]))
+	if notok := utils.HandleWarning(func() {
+		conn.sendReply(501, "Syntax error in parameters or arguments.")
+	}, err); notok {
+		return
+	}
+	conn.setActiveAddr(activeAddr)
+}
+
+// setActiveAddr switches the connection to `active` mode towards the user end-point
+// requested by a PORT or EPRT command
+func (conn *ftpConnection) setActiveAddr(activeAddr *net.TCPAddr) {
+	// Refuse to connect to third party hosts (FTP bounce attack) or privileged services
+	if !conn.dataPeerAllowed(activeAddr.IP) || activeAddr.Port < 1024 {
+		log.Println("Refusing active data connection to " + activeAddr.String() +
+			" for control connection " + conn.control.RemoteAddr().String())
+		conn.sendReply(504, "Command not implemented for that parameter.")
+		return
+	}
+
+	conn.discardDataConnection()
+	// Transition from `passive` mode to `active` mode
+	conn.closePassive()
 	conn.activeAddr = activeAddr
 	conn.sendReply(200, "Command okay.")
 }
 
+// dataPeerAllowed reports whether a data connection may be made with `ip`. Unless server
+// to server transfers (FXP) are enabled, only the host of the control connection is allowed.
+func (conn *ftpConnection) dataPeerAllowed(ip net.IP) bool {
+	if globalServerSettings.AllowFXP {
+		return true
+	}
+	return ip.Equal(net.ParseIP(conn.remoteIP()))
+}
+
 // openDataConnection handles establishing the data connection subject to `passive`
-// or `active` flag set by user
-func (conn *ftpConnection) openDataConnection() error {
+// or `active` flag set by user. A non empty `note` replaces the text of the preliminary
+// reply, such as the `FILE: <name>` announcing the name chosen by STOU (RFC 1123).
+func (conn *ftpConnection) openDataConnection(note string) error {
+	// In block mode the data connection stays open between transfers
+	if conn.ctx.TransferMode == "B" && conn.dataReusable {
+		conn.sendReply(125, replyText("Data connection already open. Transfer starting.", note))
+		return nil
+	}
 	if conn.isPasv {
 		// Block until user sends connection request to server
-		interval, _ := time.ParseDuration("1s")
-		timeout, _ := time.ParseDuration("5s")
-		wait.Poll(interval, timeout, wait.ConditionFunc(func() (bool, error) {
-			return conn.data != nil, nil
-		}))
 		if conn.data == nil {
-			return fmt.Errorf("User did not make connection before timeout")
+			select {
+			case data := <-conn.pasvData:
+				conn.data = data
+			case <-time.After(5 * time.Second):
+				return fmt.Errorf("User did not make connection before timeout")
+			}
 		}
-		conn.sendReply(125, "Data connection already open. Transfer starting.")
+		conn.sendReply(125, replyText("Data connection already open. Transfer starting.", note))
 	} else {
 		// Make connection request to user
-		conn.sendReply(150, "File status okay; about to open data connection.")
-		data, err := net.Dial("tcp4", conn.activeAddr.String())
+		conn.sendReply(150, replyText("File status okay; about to open data connection.", note))
+		// EPRT addresses may be IPv6
+		data, err := net.Dial("tcp", conn.activeAddr.String())
 		if err != nil {
 			return err
 		}
 		conn.data = data
 	}
+	// Protected data channels are TLS connections on which the server acts as the TLS server
+	if conn.ctx.Protection == "P" {
+		tlsData := tls.Server(conn.data, globalTLSConfig)
+		if err := tlsData.Handshake(); err != nil {
+			conn.data.Close()
+			conn.data = nil
+			return err
+		}
+		conn.data = tlsData
+	}
 	return nil
 }
+
+// closeDataConnection ends the data connection after a transfer. In block mode, where the
+// end of a file is marked by an EOF block, it is kept open for the next transfer unless
+// the transfer failed.
+func (conn *ftpConnection) closeDataConnection(transferErr error) {
+	if conn.data == nil {
+		return
+	}
+	if conn.ctx.TransferMode == "B" && transferErr == nil {
+		conn.dataReusable = true
+		return
+	}
+	conn.discardDataConnection()
+}
+
+// sendTransferComplete replies to a successful transfer, telling whether the data
+// connection was closed or kept open for the next transfer. A non empty `note` replaces
+// the text of the reply.
+func (conn *ftpConnection) sendTransferComplete(note string) {
+	if conn.dataReusable {
+		conn.sendReply(250, replyText("Requested file action okay, completed.", note))
+	} else {
+		conn.sendReply(226, replyText("Closing data connection. Requested file action successful", note))
+	}
+}
+
+// replyText returns `note` if set, otherwise the default text of a reply
+func replyText(text string, note string) string {
+	if note != "" {
+		return note
+	}
+	return text
+}
+
+// abor handles a user 'ABOR' control command, aborting the ongoing data transfer or hash
+// computation. The aborted command is answered first, then the abort itself.
+func (conn *ftpConnection) abor() {
+	if !conn.ongoingFileTransfer {
+		conn.sendReply(226, "Closing data connection. Requested file action successful")
+		return
+	}
+	if conn.cancelTransfer != nil {
+		conn.cancelTransfer()
+	}
+	if conn.data != nil {
+		conn.data.Close()
+	}
+	go func() {
+		wait.PollInfinite(10*time.Millisecond, wait.ConditionFunc(func() (bool, error) {
+			return !conn.ongoingFileTransfer, nil
+		}))
+		conn.sendReply(226, "Closing data connection. Abort successful.")
+	}()
+}
+
+// discardDataConnection closes any data connection, including one kept open in block mode
+func (conn *ftpConnection) discardDataConnection() {
+	if conn.data != nil {
+		conn.data.Close()
+		conn.data = nil
+	}
+	conn.dataReusable = false
+}
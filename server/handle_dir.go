@@ -2,7 +2,8 @@ package server
 
 import (
 	"fmt"
-	"os/exec"
+	"os"
+	"path"
 	"strings"
 
 	"github.com/Charana123/ftp/utils"
@@ -16,7 +17,7 @@ func (conn *ftpConnection) cwd(args []string) {
 	}, err); notok {
 		return
 	}
-	if !utils.IsDirectory(filePath) {
+	if info, err := conn.storage().Stat(filePath); err != nil || !info.IsDir() {
 		conn.sendReply(550, "Requested action not taken. File unavailable.")
 		return
 	}
@@ -24,30 +25,271 @@ func (conn *ftpConnection) cwd(args []string) {
 	conn.sendReply(250, "Requested file action okay, completed.")
 }
 
+// listOptions are the `ls` flags accepted by LIST and NLST
+type listOptions struct {
+	all       bool // -a: include hidden entries
+	long      bool // -l: long format (NLST only, LIST always is)
+	recursive bool // -R: list subdirectories recursively
+}
+
+// parseListArgs separates the `ls` style flags of a LIST or NLST command from its
+// optional path or glob pattern
+func parseListArgs(args []string) (listOptions, string) {
+	var opts listOptions
+	target := make([]string, 0, len(args))
+	for _, arg := range args {
+		if len(target) == 0 && len(arg) > 1 && arg[0] == '-' {
+			for _, flag := range arg[1:] {
+				switch flag {
+				case 'a', 'A':
+					opts.all = true
+				case 'l':
+					opts.long = true
+				case 'R':
+					opts.recursive = true
+				}
+			}
+			continue
+		}
+		target = append(target, arg)
+	}
+	// Arguments are split on spaces, so a path containing spaces spans several of them
+	return opts, strings.Join(target, " ")
+}
+
+// listMaxDepth returns how many levels of subdirectories a recursive listing descends
+func listMaxDepth() int {
+	if globalServerSettings.ListMaxDepth > 0 {
+		return globalServerSettings.ListMaxDepth
+	}
+	return 8
+}
+
+// listedEntry is an entry of a listing along with the path it is listed under
+type listedEntry struct {
+	info os.FileInfo
+	path string // Absolute path of the entry
+	name string // Name shown by NLST, relative to the listed directory or pattern
+}
+
+// readListedDir returns the visible and accessible entries of a directory
+func (conn *ftpConnection) readListedDir(dirPath string, prefix string, opts listOptions) ([]listedEntry, error) {
+	infos, err := conn.storage().ReadDir(dirPath)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]listedEntry, 0, len(infos))
+	for _, info := range infos {
+		if !opts.all && strings.HasPrefix(info.Name(), ".") {
+			continue
+		}
+		entryPath := path.Join(dirPath, info.Name())
+		if !conn.checkAccessControl(entryPath) {
+			continue
+		}
+		entries = append(entries, listedEntry{info: info, path: entryPath, name: prefix + info.Name()})
+	}
+	return entries, nil
+}
+
+// collectListing returns the entries matched by the target of a LIST or NLST command: the
+// contents of a directory, a single file or the files matching a glob pattern
+func (conn *ftpConnection) collectListing(target string, opts listOptions) ([]listedEntry, error) {
+	if target == "" {
+		return conn.readListedDir(conn.ctx.CWD, "", opts)
+	}
+	if strings.ContainsAny(target, "*?[") {
+		// Only the last path element may be a pattern; names are listed as the user wrote them
+		dir, pattern := path.Split(target)
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, err
+		}
+		dirArgs := []string{}
+		if dir != "" {
+			dirArgs = append(dirArgs, dir)
+		}
+		dirPath, err := conn.resolvePath(dirArgs)
+		if err != nil {
+			return nil, err
+		}
+		// Patterns matching hidden files explicitly list them, like a shell would
+		opts.all = opts.all || strings.HasPrefix(pattern, ".")
+		entries, err := conn.readListedDir(dirPath, dir, opts)
+		if err != nil {
+			return nil, err
+		}
+		matched := make([]listedEntry, 0, len(entries))
+		for _, entry := range entries {
+			if ok, _ := path.Match(pattern, entry.info.Name()); ok {
+				matched = append(matched, entry)
+			}
+		}
+		return matched, nil
+	}
+
+	filePath, err := conn.resolvePath([]string{target})
+	if err != nil {
+		return nil, err
+	}
+	info, err := conn.storage().Stat(filePath)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return conn.readListedDir(filePath, "", opts)
+	}
+	return []listedEntry{{info: info, path: filePath, name: target}}, nil
+}
+
+// writeListing writes the entries in the configured LIST format or, for NLST without -l,
+// as bare names. Subdirectories are descended into when listing recursively.
+func (conn *ftpConnection) writeListing(b *strings.Builder, entries []listedEntry, opts listOptions, names bool, depth int) {
+	infos := make([]os.FileInfo, 0, len(entries))
+	for _, entry := range entries {
+		if names {
+			b.WriteString(entry.name + "\r\n")
+		}
+		infos = append(infos, entry.info)
+	}
+	if !names {
+		b.WriteString(formatListing(infos, globalServerSettings.ListFormat))
+	}
+	if !opts.recursive || depth >= listMaxDepth() {
+		return
+	}
+	for _, entry := range entries {
+		if !entry.info.IsDir() {
+			continue
+		}
+		subEntries, err := conn.readListedDir(entry.path, entry.name+"/", opts)
+		if err != nil {
+			continue
+		}
+		if !names {
+			b.WriteString("\r\n" + entry.name + ":\r\n")
+		}
+		conn.writeListing(b, subEntries, opts, names, depth+1)
+	}
+}
+
 // list handles a user 'LIST' control command
-func (conn *ftpConnection) list() {
+func (conn *ftpConnection) list(args []string) {
+	opts, target := parseListArgs(args)
+	conn.sendListing(target, opts, false)
+}
+
+// nlst handles a user 'NLST' control command, listing bare names unless -l is given
+func (conn *ftpConnection) nlst(args []string) {
+	opts, target := parseListArgs(args)
+	conn.sendListing(target, opts, !opts.long)
+}
+
+// sendListing sends the listing of `target` over the data connection
+func (conn *ftpConnection) sendListing(target string, opts listOptions, names bool) {
 	go func() {
 		conn.ongoingFileTransfer = true
+		defer func() {
+			conn.ongoingFileTransfer = false
+		}()
 
-		directoryPath := conn.ctx.CWD
-		out, err := exec.Command("/bin/sh", "-c", "ls -l "+directoryPath).Output()
+		entries, err := conn.collectListing(target, opts)
 		if notok := utils.HandleWarning(func() {
-			conn.sendReply(451, "Requested action aborted. Local error in processing.")
+			conn.sendReply(550, "Requested action not taken. File unavailable.")
 		}, err); notok {
 			return
 		}
+		var listing strings.Builder
+		conn.writeListing(&listing, entries, opts, names, 0)
+		conn.sendText(listing.String())
+	}()
+}
+
+// sendText sends a listing over the data connection
+func (conn *ftpConnection) sendText(text string) {
+	err := conn.openDataConnection("")
+	if notok := utils.HandleWarning(func() {
+		conn.sendReply(425, "Can't open data connection.")
+	}, err); notok {
+		return
+	}
+	// Listings are already in the ASCII representation
+	dst, finish := conn.transferWriter(false, 0)
+	_, err = fmt.Fprint(dst, text)
+	if finishErr := finish(); err == nil {
+		err = finishErr
+	}
+	conn.closeDataConnection(err)
+	if notok := utils.HandleWarning(func() {
+		conn.sendReply(426, "Connection closed; transfer aborted.")
+	}, err); notok {
+		return
+	}
+	conn.sendTransferComplete("")
+}
+
+// mlsd handles a user 'MLSD' control command (RFC 3659), listing the entries of a directory
+// with their facts
+func (conn *ftpConnection) mlsd(args []string) {
+	go func() {
+		conn.ongoingFileTransfer = true
+		defer func() {
+			conn.ongoingFileTransfer = false
+		}()
 
-		err = conn.openDataConnection()
+		dirArgs := []string{}
+		if len(args) > 0 {
+			// Arguments are split on spaces, so a path containing spaces spans several of them
+			dirArgs = append(dirArgs, strings.Join(args, " "))
+		}
+		dirPath, err := conn.resolvePath(dirArgs)
 		if notok := utils.HandleWarning(func() {
-			conn.sendReply(425, "Can't open data connection.")
+			conn.sendReply(550, "Requested action not taken. File unavailable.")
 		}, err); notok {
 			return
 		}
-		data := strings.Join(strings.Split(string(out), "\n"), "\r\n")
-		fmt.Fprint(conn.data, data)
-		conn.data.Close()
-		conn.sendReply(226, "Closing data connection. Requested file action successful")
-
-		conn.ongoingFileTransfer = false
+		info, err := conn.storage().Stat(dirPath)
+		if notok := utils.HandleWarning(func() {
+			conn.sendReply(550, "Requested action not taken. File unavailable.")
+		}, err); notok {
+			return
+		}
+		if !info.IsDir() {
+			conn.sendReply(501, "Syntax error in parameters or arguments. Not a directory.")
+			return
+		}
+		entries, err := conn.readListedDir(dirPath, "", listOptions{all: true})
+		if notok := utils.HandleWarning(func() {
+			conn.sendReply(550, "Requested action not taken. File unavailable.")
+		}, err); notok {
+			return
+		}
+		var listing strings.Builder
+		for _, entry := range entries {
+			listing.WriteString(formatFacts(entry.info, conn.writable(entry.path)) + " " + entry.info.Name() + "\r\n")
+		}
+		conn.sendText(listing.String())
 	}()
 }
+
+// mlst handles a user 'MLST' control command (RFC 3659), replying with the facts of a file
+// or directory over the control connection
+func (conn *ftpConnection) mlst(args []string) {
+	fileArgs := []string{}
+	if len(args) > 0 {
+		fileArgs = append(fileArgs, strings.Join(args, " "))
+	}
+	filePath, err := conn.resolvePath(fileArgs)
+	if notok := utils.HandleWarning(func() {
+		conn.sendReply(550, "Requested action not taken. File unavailable.")
+	}, err); notok {
+		return
+	}
+	info, err := conn.storage().Stat(filePath)
+	if notok := utils.HandleWarning(func() {
+		conn.sendReply(550, "Requested action not taken. File unavailable.")
+	}, err); notok {
+		return
+	}
+	facts := formatFacts(info, conn.writable(filePath)) + " " + filePath
+	conn.sendMultilineReply(250, "Listing "+filePath, []string{facts}, "End")
+}
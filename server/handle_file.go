@@ -5,10 +5,10 @@ import (
 	"fmt"
 	"io"
 	"os"
-	"os/exec"
 	"path"
-	"runtime"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/Charana123/ftp/utils"
 )
@@ -31,10 +31,38 @@ func (conn *ftpConnection) resolvePath(args []string) (string, error) {
 	return filePath, nil
 }
 
+// rest handles a user 'REST' control command, setting the offset from which the next
+// RETR or STOR resumes. In MODE B the offset is a server marker sent in a restart marker
+// block or a 110 reply, which are offsets of the transferred data.
+func (conn *ftpConnection) rest(args []string) {
+	if len(args) == 0 {
+		conn.sendReply(501, "Syntax error in parameters or arguments.")
+		return
+	}
+	offset, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil || offset < 0 {
+		conn.sendReply(501, "Syntax error in parameters or arguments.")
+		return
+	}
+	conn.restartOffset = offset
+	conn.sendReply(350, "Requested file action pending further information.")
+}
+
+// takeRestartOffset returns the offset set by REST for this transfer and clears it
+func (conn *ftpConnection) takeRestartOffset() int64 {
+	offset := conn.restartOffset
+	conn.restartOffset = 0
+	return offset
+}
+
 // retr handles a user 'RETR' control command
 func (conn *ftpConnection) retr(args []string) {
+	offset := conn.takeRestartOffset()
 	go func() {
 		conn.ongoingFileTransfer = true
+		defer func() {
+			conn.ongoingFileTransfer = false
+		}()
 
 		filePath, err := conn.resolvePath(args)
 		if notok := utils.HandleWarning(func() {
@@ -43,38 +71,80 @@ func (conn *ftpConnection) retr(args []string) {
 			return
 		}
 
-		if ok := utils.IsFile(filePath); ok {
-			file, err := os.Open(filePath)
-			defer file.Close()
-			if notok := utils.HandleWarning(func() {
-				conn.sendReply(550, "Requested action not taken. File unavailable.")
-			}, err); notok {
-				return
-			}
+		info, err := conn.storage().Stat(filePath)
+		if err == nil && info.IsDir() {
+			err = errors.New("Argument isn't file")
+		}
+		if notok := utils.HandleWarning(func() {
+			conn.sendReply(550, "Requested action not taken. File unavailable.")
+		}, err); notok {
+			return
+		}
+		if offset > info.Size() {
+			utils.HandleWarning(func() {
+				conn.sendReply(554, "Requested action not taken: invalid REST parameter.")
+			}, errors.New("Restart offset beyond end of file"))
+			return
+		}
+		file, err := conn.storage().Open(filePath, offset)
+		if notok := utils.HandleWarning(func() {
+			conn.sendReply(550, "Requested action not taken. File unavailable.")
+		}, err); notok {
+			return
+		}
+		defer file.Close()
 
-			err = conn.openDataConnection()
-			if notok := utils.HandleWarning(func() {
-				conn.sendReply(425, "Can't open data connection.")
-			}, err); notok {
-				return
-			}
+		err = conn.openDataConnection("")
+		if notok := utils.HandleWarning(func() {
+			conn.sendReply(425, "Can't open data connection.")
+		}, err); notok {
+			return
+		}
 
-			io.Copy(conn.data, file)
-			conn.data.Close()
-			conn.sendReply(226, "Closing data connection. Requested file action successful")
-		} else {
-			utils.HandleWarning(func() {
-				conn.sendReply(550, "Requested action not taken. File unavailable.")
-			}, errors.New("Argument isn't file"))
+		dst, finish := conn.transferWriter(true, offset)
+		n, err := io.Copy(dst, file)
+		if finishErr := finish(); err == nil {
+			err = finishErr
 		}
-		conn.ongoingFileTransfer = false
+		conn.ctx.countDownload(n, err == nil)
+		conn.closeDataConnection(err)
+		if notok := utils.HandleWarning(func() {
+			conn.sendReply(426, "Connection closed; transfer aborted.")
+		}, err); notok {
+			return
+		}
+		conn.sendTransferComplete("")
 	}()
 }
 
 // stor handles a user 'STOR' control command
 func (conn *ftpConnection) stor(args []string) {
+	conn.storeFile(args, false)
+}
+
+// stou handles a user 'STOU' control command, storing the file under a name unused in
+// the target directory, derived from the optional name given
+func (conn *ftpConnection) stou(args []string) {
+	if len(args) == 0 {
+		args = []string{stouBaseName()}
+	}
+	conn.storeFile(args, true)
+}
+
+// storeFile stores the file received over the data connection, under a unique name for
+// STOU or when the overwrite policy of the target directory asks for it
+func (conn *ftpConnection) storeFile(args []string, unique bool) {
+	offset := conn.takeRestartOffset()
+	if unique {
+		offset = 0
+	}
+	expected := conn.takeExpectedHash()
 	go func() {
 		conn.ongoingFileTransfer = true
+		defer func() {
+			conn.ongoingFileTransfer = false
+		}()
+
 		filePath, err := conn.resolvePath(args)
 		if notok := utils.HandleWarning(func() {
 			conn.sendReply(553, "Requested action not taken. File name not allowed.")
@@ -82,30 +152,131 @@ func (conn *ftpConnection) stor(args []string) {
 			return
 		}
 
-		// Creates or Overwrites the specified file
-		file, err := os.Create(filePath)
-		defer file.Close()
+		target, err := conn.uploadTarget(filePath, unique, offset)
+		if notok := utils.HandleWarning(func() {
+			if err == errFileExists {
+				conn.sendReply(550, "Requested action not taken. File already exists.")
+			} else {
+				conn.sendReply(451, "Requested action aborted. Local error in processing.")
+			}
+		}, err); notok {
+			return
+		}
+		if target.claimed {
+			defer releaseUploadPath(target.path)
+		}
+		filePath = target.path
+		// Unique names are announced as described by RFC 1123
+		var startNote, completeNote string
+		if target.unique {
+			startNote = "FILE: " + path.Base(filePath)
+			completeNote = "Transfer complete (unique file name:" + path.Base(filePath) + ")."
+		}
+
+		// Creates or Overwrites the specified file, or when resuming an upload
+		// keeps its contents up to the restart offset. The file is hashed as it is
+		// stored, starting with any contents kept.
+		uploadPath, file, h, err := conn.createUpload(filePath, offset, expected != "")
 		if notok := utils.HandleWarning(func() {
 			conn.sendReply(550, "Requested action not taken. File unavailable.")
 		}, err); notok {
 			return
 		}
 
-		err = conn.openDataConnection()
+		err = conn.openDataConnection(startNote)
 		if notok := utils.HandleWarning(func() {
+			abortWrite(file)
+			conn.discardUpload(filePath, uploadPath)
 			conn.sendReply(425, "Can't open data connection.")
 		}, err); notok {
 			return
 		}
 
-		io.Copy(file, conn.data)
-		conn.data.Close()
-		conn.sendReply(226, "Closing data connection. Requested file action successful")
-		conn.ongoingFileTransfer = false
+		src, err := conn.transferReader(offset)
+		if notok := utils.HandleWarning(func() {
+			abortWrite(file)
+			conn.discardUpload(filePath, uploadPath)
+			conn.closeDataConnection(err)
+			conn.sendReply(426, "Connection closed; transfer aborted.")
+		}, err); notok {
+			return
+		}
+		dst := &storageWriter{Writer: file}
+		n, err := io.Copy(io.MultiWriter(dst, h), src)
+		// The storage may only commit the file once it is closed
+		if err != nil {
+			abortWrite(file)
+		} else if err = file.Close(); err != nil {
+			dst.err = err
+		}
+		conn.ctx.countUpload(n, err == nil)
+		conn.closeDataConnection(err)
+		if notok := utils.HandleWarning(func() {
+			conn.discardUpload(filePath, uploadPath)
+			if dst.err != nil {
+				conn.sendReply(451, "Requested action aborted. Local error in processing.")
+			} else {
+				conn.sendReply(426, "Connection closed; transfer aborted.")
+			}
+		}, err); notok {
+			return
+		}
+		err = conn.completeUpload(filePath, uploadPath, offset+n, h.Sum(nil), expected)
+		if notok := utils.HandleWarning(func() {
+			if err == errHashMismatch {
+				conn.sendReply(550, "Requested action not taken. File does not match the expected hash and was quarantined.")
+			} else {
+				conn.sendReply(451, "Requested action aborted. Local error in processing.")
+			}
+		}, err); notok {
+			return
+		}
+		conn.sendTransferComplete(completeNote)
 	}()
 }
 
-// size handles a user 'SIZE' control command
+// storageWriter records the failure of a write to the storage, telling it apart from a
+// failure of the data connection
+type storageWriter struct {
+	io.Writer
+	err error
+}
+
+func (w *storageWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	if err != nil {
+		w.err = err
+	}
+	return n, err
+}
+
+// dele handles a user 'DELE' control command
+func (conn *ftpConnection) dele(args []string) {
+	filePath, err := conn.resolvePath(args)
+	if notok := utils.HandleWarning(func() {
+		conn.sendReply(553, "Requested action not taken. File name not allowed.")
+	}, err); notok {
+		return
+	}
+
+	// Directories are removed with RMD
+	info, err := conn.storage().Stat(filePath)
+	if err == nil && info.IsDir() {
+		err = errors.New("Argument isn't file")
+	}
+	if err == nil {
+		err = conn.storage().Remove(filePath)
+	}
+	if notok := utils.HandleWarning(func() {
+		conn.sendReply(550, "Requested action not taken. File unavailable.")
+	}, err); notok {
+		return
+	}
+	conn.sendReply(250, "Requested file action okay, completed.")
+}
+
+// size handles a user 'SIZE' control command (RFC 3659), replying with the number of
+// bytes a RETR of the file would transfer in the current TYPE
 func (conn *ftpConnection) size(args []string) {
 	filePath, err := conn.resolvePath(args)
 	if notok := utils.HandleWarning(func() {
@@ -114,50 +285,161 @@ func (conn *ftpConnection) size(args []string) {
 		return
 	}
 
-	// Check if the specified file or directory exists
-	if exists := utils.Exists(filePath); !exists {
+	// SIZE is only defined for files
+	info, err := conn.storage().Stat(filePath)
+	if err == nil && info.IsDir() {
+		err = errors.New("Argument isn't file")
+	}
+	if notok := utils.HandleWarning(func() {
 		conn.sendReply(550, "Requested action not taken. File unavailable.")
+	}, err); notok {
 		return
 	}
-	var cmd *exec.Cmd
-	if runtime.GOOS == "darwin" {
-		cmd = exec.Command("/bin/sh", "-c", "find "+filePath+" -type f -print0 | xargs -0 stat -f%z | awk '{b+=$1} END {print b}'")
+	// The size of a file transferred in ASCII differs from its size on disk
+	if conn.ctx.TransferType == "A" {
+		conn.asciiSize(filePath, info)
+		return
 	}
-	if runtime.GOOS == "linux" {
-		cmd = exec.Command("/bin/sh", "-c", "du -sb "+filePath)
+	conn.sendReply(213, strconv.FormatInt(info.Size(), 10))
+}
+
+// asciiSize replies to a SIZE command in TYPE A with the size of the file once converted
+// to CRLF line endings, unless the server refuses to compute it. Sizes are cached until
+// the file is modified.
+func (conn *ftpConnection) asciiSize(filePath string, info os.FileInfo) {
+	if globalServerSettings.RefuseASCIISize {
+		conn.sendReply(550, "Requested action not taken. File unavailable.")
+		return
+	}
+	if size, ok := globalASCIISizes.get(conn.cacheKey(filePath), info); ok {
+		conn.sendReply(213, strconv.FormatInt(size.(int64), 10))
+		return
+	}
+	file, err := conn.storage().Open(filePath, 0)
+	if notok := utils.HandleWarning(func() {
+		conn.sendReply(550, "Requested action not taken. File unavailable.")
+	}, err); notok {
+		return
 	}
-	out, err := cmd.Output()
+	defer file.Close()
+	size, err := asciiSize(file)
 	if notok := utils.HandleWarning(func() {
 		conn.sendReply(451, "Requested action aborted. Local error in processing.")
 	}, err); notok {
 		return
 	}
-	conn.sendReply(213, strings.Trim(string(out), "\r\n"))
+	globalASCIISizes.put(conn.cacheKey(filePath), info, size)
+	conn.sendReply(213, strconv.FormatInt(size, 10))
+}
 
+// ftpTimeFormat is the YYYYMMDDHHMMSS time-val format of RFC 3659, always in UTC
+const ftpTimeFormat = "20060102150405"
+
+// formatFTPTime formats a time as an RFC 3659 time-val, with milliseconds when non zero
+func formatFTPTime(t time.Time) string {
+	t = t.UTC()
+	if ms := t.Nanosecond() / int(time.Millisecond); ms != 0 {
+		return t.Format(ftpTimeFormat) + fmt.Sprintf(".%03d", ms)
+	}
+	return t.Format(ftpTimeFormat)
 }
 
-// TODO
+// parseFTPTime parses an RFC 3659 time-val, YYYYMMDDHHMMSS[.sss] in UTC
+func parseFTPTime(value string) (time.Time, error) {
+	whole, fraction := value, ""
+	if i := strings.IndexByte(value, '.'); i >= 0 {
+		whole, fraction = value[:i], value[i+1:]
+	}
+	t, err := time.ParseInLocation(ftpTimeFormat, whole, time.UTC)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if fraction != "" {
+		digits, err := strconv.Atoi(fraction)
+		if err != nil || digits < 0 || len(fraction) > 9 {
+			return time.Time{}, fmt.Errorf("invalid fraction of second %q", fraction)
+		}
+		for i := len(fraction); i < 9; i++ {
+			digits *= 10
+		}
+		t = t.Add(time.Duration(digits))
+	}
+	return t, nil
+}
+
+// mdtm handles a user 'MDTM' control command (RFC 3659)
 func (conn *ftpConnection) mdtm(args []string) {
-	filePath := args[0]
-	filePath = path.Join(conn.ctx.CWD, filePath)
+	filePath, err := conn.resolvePath(args)
+	if notok := utils.HandleWarning(func() {
+		conn.sendReply(550, "Requested action not taken. File unavailable (e.g., file not found, no access).")
+	}, err); notok {
+		return
+	}
 
-	if exists := utils.Exists(filePath); !exists {
+	info, err := conn.storage().Stat(filePath)
+	if notok := utils.HandleWarning(func() {
 		conn.sendReply(550, "Requested action not taken. File unavailable (e.g., file not found, no access).")
+	}, err); notok {
 		return
 	}
-	var cmd *exec.Cmd
-	// TODO - Should be in GMT (not seconds since epoch)
-	if runtime.GOOS == "darwin" {
-		cmd = exec.Command("/bin/sh", "-c", "stat -f\"%m\" "+filePath)
+	conn.sendReply(213, formatFTPTime(info.ModTime()))
+}
+
+// parseTimeAndPath parses the `<time-val> <path>` arguments of MFMT and MFCT
+func (conn *ftpConnection) parseTimeAndPath(args []string) (time.Time, string, bool) {
+	if len(args) < 2 {
+		conn.sendReply(501, "Syntax error in parameters or arguments.")
+		return time.Time{}, "", false
 	}
-	if runtime.GOOS == "linux" {
-		cmd = exec.Command("/bin/sh", "-c", "stat --printf \"%Y\" "+filePath)
+	t, err := parseFTPTime(args[0])
+	if notok := utils.HandleWarning(func() {
+		conn.sendReply(501, "Syntax error in parameters or arguments.")
+	}, err); notok {
+		return time.Time{}, "", false
 	}
-	out, err := cmd.Output()
+	// Arguments are split on spaces, so a path containing spaces spans several of them
+	filePath, err := conn.resolvePath([]string{strings.Join(args[1:], " ")})
 	if notok := utils.HandleWarning(func() {
-		conn.sendReply(451, "Requested action aborted. Local error in processing.")
+		conn.sendReply(550, "Requested action not taken. File unavailable (e.g., file not found, no access).")
+	}, err); notok {
+		return time.Time{}, "", false
+	}
+	return t, filePath, true
+}
+
+// mfmt handles a user 'MFMT' control command (draft-somers-ftp-mfxx), setting the
+// modification time of a file
+func (conn *ftpConnection) mfmt(args []string) {
+	t, filePath, ok := conn.parseTimeAndPath(args)
+	if !ok {
+		return
+	}
+	err := conn.storage().Chtimes(filePath, t)
+	if notok := utils.HandleWarning(func() {
+		conn.sendReply(550, "Requested action not taken. File unavailable (e.g., file not found, no access).")
+	}, err); notok {
+		return
+	}
+	conn.sendReply(213, "Modify="+formatFTPTime(t)+"; "+strings.Join(args[1:], " "))
+}
+
+// mfct handles a user 'MFCT' control command (draft-somers-ftp-mfxx), setting the
+// creation time of a file on filesystems that support it
+func (conn *ftpConnection) mfct(args []string) {
+	t, filePath, ok := conn.parseTimeAndPath(args)
+	if !ok {
+		return
+	}
+	storage, ok := conn.creationTimeStorage(filePath)
+	if !ok {
+		conn.sendReply(502, "Command not implemented.")
+		return
+	}
+	err := storage.SetCreationTime(filePath, t)
+	if notok := utils.HandleWarning(func() {
+		conn.sendReply(550, "Requested action not taken. File unavailable (e.g., file not found, no access).")
 	}, err); notok {
 		return
 	}
-	conn.sendReply(213, strings.Trim(string(out), "\r\n"))
+	conn.sendReply(213, "Create="+formatFTPTime(t)+"; "+strings.Join(args[1:], " "))
 }
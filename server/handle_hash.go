@@ -0,0 +1,235 @@
+package server
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/Charana123/ftp/utils"
+)
+
+// hashAlgorithms are the algorithms of the HASH command (draft-bryan-ftpext-hash) by name
+var hashAlgorithms = map[string]func() hash.Hash{
+	"SHA-1":   sha1.New,
+	"SHA-256": sha256.New,
+	"SHA-512": sha512.New,
+	"MD5":     md5.New,
+	"CRC32":   func() hash.Hash { return crc32.NewIEEE() },
+}
+
+// hashAlgorithmNames lists the hash algorithms in the order advertised by FEAT
+var hashAlgorithmNames = []string{"SHA-1", "SHA-256", "SHA-512", "MD5", "CRC32"}
+
+// defaultHashAlgorithm is the algorithm used by HASH until another is selected with OPTS HASH
+const defaultHashAlgorithm = "SHA-1"
+
+// byteRange is a range of bytes of a file, from `start` up to and including `end`.
+// An `end` of -1 stands for the end of the file.
+type byteRange struct {
+	start int64
+	end   int64
+}
+
+// globalHashes caches the hashes of files, sized by ServerSettings.HashCacheSize
+var globalHashes = newFileCache(0)
+
+// hashFeature returns the HASH feature line listing the algorithms, the selected one starred
+func (conn *ftpConnection) hashFeature() string {
+	names := make([]string, 0, len(hashAlgorithmNames))
+	for _, name := range hashAlgorithmNames {
+		if name == conn.ctx.HashAlgorithm {
+			name += "*"
+		}
+		names = append(names, name)
+	}
+	return "HASH " + strings.Join(names, ";")
+}
+
+// optsHash handles the `OPTS HASH [<algorithm>]` command querying or selecting the
+// algorithm used by HASH
+func (conn *ftpConnection) optsHash(args []string) {
+	if len(args) == 0 {
+		conn.sendReply(200, conn.ctx.HashAlgorithm)
+		return
+	}
+	algorithm := strings.ToUpper(args[0])
+	if _, ok := hashAlgorithms[algorithm]; !ok {
+		conn.sendReply(504, "Unknown hash algorithm.")
+		return
+	}
+	conn.ctx.HashAlgorithm = algorithm
+	conn.sendReply(200, algorithm)
+}
+
+// rang handles a user 'RANG' control command, setting the range of bytes hashed by the next
+// HASH command. `RANG 1 0` resets the range to the whole file.
+func (conn *ftpConnection) rang(args []string) {
+	if len(args) != 2 {
+		conn.sendReply(501, "Syntax error in parameters or arguments.")
+		return
+	}
+	start, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil || start < 0 {
+		conn.sendReply(501, "Syntax error in parameters or arguments.")
+		return
+	}
+	end, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil || end < 0 {
+		conn.sendReply(501, "Syntax error in parameters or arguments.")
+		return
+	}
+	if start == 1 && end == 0 {
+		conn.hashRange = nil
+		conn.sendReply(350, "Restarting at 0. Ending at end of file.")
+		return
+	}
+	if end < start {
+		conn.sendReply(501, "Syntax error in parameters or arguments.")
+		return
+	}
+	conn.hashRange = &byteRange{start: start, end: end}
+	conn.sendReply(350, fmt.Sprintf("Restarting at %d. Ending at %d.", start, end))
+}
+
+// hash handles a user 'HASH' control command (draft-bryan-ftpext-hash), replying with the
+// hash of a file, or of the range of it set with RANG, in the algorithm selected with
+// OPTS HASH
+func (conn *ftpConnection) hash(args []string) {
+	algorithm := conn.ctx.HashAlgorithm
+	r := byteRange{start: 0, end: -1}
+	if conn.hashRange != nil {
+		r = *conn.hashRange
+		conn.hashRange = nil
+	}
+	// Arguments are split on spaces, so a path containing spaces spans several of them
+	name := strings.Join(args, " ")
+	conn.sendHash(name, algorithm, r, func(sum []byte, r byteRange) {
+		conn.sendReply(213, fmt.Sprintf("%s %d-%d %s %s", algorithm, r.start, r.end, hex.EncodeToString(sum), name))
+	})
+}
+
+// legacyHash handles the legacy 'XMD5', 'XSHA1', 'XSHA256' and 'XCRC' control commands,
+// taking a path optionally followed by the offsets at which hashing starts and stops
+func (conn *ftpConnection) legacyHash(algorithm string, args []string) {
+	r := byteRange{start: 0, end: -1}
+	// Trailing numbers are offsets, as long as a path precedes them
+	var offsets []int64
+	for len(args) > 1 && len(offsets) < 2 {
+		offset, err := strconv.ParseInt(args[len(args)-1], 10, 64)
+		if err != nil || offset < 0 {
+			break
+		}
+		offsets = append([]int64{offset}, offsets...)
+		args = args[:len(args)-1]
+	}
+	if len(offsets) > 0 {
+		r.start = offsets[0]
+	}
+	if len(offsets) > 1 {
+		if offsets[1] <= r.start {
+			conn.sendReply(501, "Syntax error in parameters or arguments.")
+			return
+		}
+		r.end = offsets[1] - 1
+	}
+	name := strings.Trim(strings.Join(args, " "), `"`)
+	conn.sendHash(name, algorithm, r, func(sum []byte, r byteRange) {
+		conn.sendReply(250, strings.ToUpper(hex.EncodeToString(sum)))
+	})
+}
+
+// sendHash computes the hash of a range of a file in the background and passes it to `reply`
+// along with the range actually hashed. The computation stops early on ABOR.
+func (conn *ftpConnection) sendHash(name string, algorithm string, r byteRange, reply func(sum []byte, r byteRange)) {
+	if name == "" {
+		conn.sendReply(501, "Syntax error in parameters or arguments.")
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	conn.cancelTransfer = cancel
+	conn.ongoingFileTransfer = true
+	go func() {
+		defer func() {
+			cancel()
+			conn.cancelTransfer = nil
+			conn.ongoingFileTransfer = false
+		}()
+
+		filePath, err := conn.resolvePath([]string{name})
+		if notok := utils.HandleWarning(func() {
+			conn.sendReply(553, "Requested action not taken. File name not allowed.")
+		}, err); notok {
+			return
+		}
+		info, err := conn.storage().Stat(filePath)
+		if err == nil && info.IsDir() {
+			err = errors.New("Argument isn't file")
+		}
+		if notok := utils.HandleWarning(func() {
+			conn.sendReply(550, "Requested action not taken. File unavailable.")
+		}, err); notok {
+			return
+		}
+		if r.end < 0 || r.end >= info.Size() {
+			r.end = info.Size() - 1
+		}
+		if r.end < 0 {
+			// Empty file
+			r.end = 0
+		}
+		if r.start > r.end {
+			conn.sendReply(501, "Syntax error in parameters or arguments.")
+			return
+		}
+
+		key := fmt.Sprintf("%s\x00%s\x00%d-%d", conn.cacheKey(filePath), algorithm, r.start, r.end)
+		if sum, ok := globalHashes.get(key, info); ok {
+			reply(sum.([]byte), r)
+			return
+		}
+		file, err := conn.storage().Open(filePath, r.start)
+		if notok := utils.HandleWarning(func() {
+			conn.sendReply(550, "Requested action not taken. File unavailable.")
+		}, err); notok {
+			return
+		}
+		defer file.Close()
+		h := hashAlgorithms[algorithm]()
+		_, err = io.Copy(h, &contextReader{ctx: ctx, r: io.LimitReader(file, r.end-r.start+1)})
+		if ctx.Err() != nil {
+			conn.sendReply(426, "Connection closed; transfer aborted.")
+			return
+		}
+		if notok := utils.HandleWarning(func() {
+			conn.sendReply(451, "Requested action aborted. Local error in processing.")
+		}, err); notok {
+			return
+		}
+		sum := h.Sum(nil)
+		globalHashes.put(key, info, sum)
+		reply(sum, r)
+	}()
+}
+
+// contextReader stops reading once its context is cancelled
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
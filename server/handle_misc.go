@@ -1,6 +1,8 @@
 package server
 
 import (
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -14,13 +16,23 @@ func (conn *ftpConnection) syst() {
 }
 
 // ttype handles a user 'TYPE' control command
-func (conn *ftpConnection) ttype(argument string) {
-	// Only support IMAGE (binary) and ASCII data representations
-	if strings.Compare(argument, "I") != 0 && strings.Compare(argument, "A") != 0 {
+func (conn *ftpConnection) ttype(args []string) {
+	if len(args) == 0 {
+		conn.sendReply(501, "Syntax error in parameters or arguments.")
+		return
+	}
+	// Only support IMAGE (binary), LOCAL 8 (same as binary) and ASCII Non-print
+	// data representations
+	switch strings.ToUpper(strings.Join(args, " ")) {
+	case "A", "A N":
+		conn.ctx.TransferType = "A"
+	case "I", "L 8":
+		conn.ctx.TransferType = "I"
+	default:
 		conn.sendReply(504, "Command not implemented for that parameter.")
-	} else {
-		conn.sendReply(200, "Command okay.")
+		return
 	}
+	conn.sendReply(200, "Command okay.")
 }
 
 // stru handles a user 'STRU' control command
@@ -33,13 +45,138 @@ func (conn *ftpConnection) stru(argument string) {
 	}
 }
 
-// mode handles a user 'MODEE' control command
-func (conn *ftpConnection) mode(argument string) {
-	// Only supports STREAM mode
-	if strings.Compare(argument, "S") != 0 {
+// mode handles a user 'MODE' control command
+func (conn *ftpConnection) mode(args []string) {
+	if len(args) == 0 {
+		conn.sendReply(501, "Syntax error in parameters or arguments.")
+		return
+	}
+	// Only supports STREAM, BLOCK and, if enabled, deflate compressed (Z) modes
+	switch mode := strings.ToUpper(args[0]); mode {
+	case "S", "B":
+		conn.setTransferMode(mode)
+		conn.sendReply(200, "Command okay.")
+	case "Z":
+		if !globalServerSettings.ModeZ {
+			conn.sendReply(504, "Command not implemented for that parameter.")
+			return
+		}
+		conn.setTransferMode(mode)
+		conn.sendReply(200, "Command okay.")
+	default:
 		conn.sendReply(504, "Command not implemented for that parameter.")
-	} else {
+	}
+}
+
+// setTransferMode changes the transmission mode. A data connection kept open in block
+// mode cannot be reused by the other modes, which close it to mark the end of a file.
+func (conn *ftpConnection) setTransferMode(mode string) {
+	if mode != "B" {
+		conn.discardDataConnection()
+	}
+	conn.ctx.TransferMode = mode
+}
+
+// features returns the extensions advertised in reply to FEAT
+func (conn *ftpConnection) features() []string {
+	features := []string{"CLNT", "EPRT", conn.hashFeature(), "MDTM", "MFMT", "MLST type*;size*;modify*;perm*;", "RANG STREAM", "REST STREAM", "SIZE", "TVFS", "UTF8"}
+	if _, ok := conn.creationTimeStorage(conn.ctx.CWD); ok {
+		features = append(features, "MFCT")
+	}
+	if globalServerSettings.ModeZ {
+		features = append(features, "MODE Z")
+	}
+	if globalTLSConfig != nil {
+		features = append(features, "PBSZ", "PROT")
+	}
+	sort.Strings(features)
+	return features
+}
+
+// feat handles a user 'FEAT' control command (RFC 2389)
+func (conn *ftpConnection) feat() {
+	conn.sendMultilineReply(211, "Extensions supported:", conn.features(), "End")
+}
+
+// clnt handles a user 'CLNT' control command, naming the client software
+func (conn *ftpConnection) clnt(args []string) {
+	conn.ctx.ClientSoftware = strings.Join(args, " ")
+	conn.sendReply(200, "Command okay.")
+}
+
+// opts handles a user 'OPTS' control command
+func (conn *ftpConnection) opts(args []string) {
+	if len(args) == 0 {
+		conn.sendReply(501, "Syntax error in parameters or arguments.")
+		return
+	}
+	switch strings.ToUpper(args[0]) {
+	case "UTF8":
+		if len(args) < 2 || (strings.ToUpper(args[1]) != "ON" && strings.ToUpper(args[1]) != "OFF") {
+			conn.sendReply(501, "Syntax error in parameters or arguments.")
+			return
+		}
+		conn.ctx.UTF8 = strings.ToUpper(args[1]) == "ON"
+		conn.sendReply(200, "Command okay.")
+	case "MODE":
+		conn.optsModeZ(args[1:])
+	case "HASH":
+		conn.optsHash(args[1:])
+	default:
+		conn.sendReply(501, "Syntax error in parameters or arguments.")
+	}
+}
+
+// optsModeZ handles the `OPTS MODE Z LEVEL <n>` command setting the compression level
+func (conn *ftpConnection) optsModeZ(args []string) {
+	// Every option after Z comes with a value
+	if !globalServerSettings.ModeZ || len(args) == 0 || strings.ToUpper(args[0]) != "Z" || len(args)%2 == 0 {
+		conn.sendReply(501, "Syntax error in parameters or arguments.")
+		return
+	}
+	for i := 1; i+1 < len(args); i += 2 {
+		if strings.ToUpper(args[i]) != "LEVEL" {
+			conn.sendReply(501, "Syntax error in parameters or arguments.")
+			return
+		}
+		level, err := strconv.Atoi(args[i+1])
+		if err != nil || level < 0 || level > 9 {
+			conn.sendReply(501, "Syntax error in parameters or arguments.")
+			return
+		}
+		conn.zlibLevel = level
+	}
+	conn.sendReply(200, "MODE Z LEVEL set to "+strconv.Itoa(conn.modeZLevel()))
+}
+
+// pbsz handles a user 'PBSZ' control command (RFC 4217), only a buffer size of 0 applies to TLS
+func (conn *ftpConnection) pbsz(args []string) {
+	if conn.ctx.TLSState == nil {
+		conn.sendReply(503, "Bad sequence of commands.")
+		return
+	}
+	conn.sendReply(200, "PBSZ=0")
+}
+
+// prot handles a user 'PROT' control command (RFC 4217), selecting a clear (C)
+// or TLS protected (P) data channel
+func (conn *ftpConnection) prot(args []string) {
+	if len(args) == 0 {
+		conn.sendReply(501, "Syntax error in parameters or arguments.")
+		return
+	}
+	if conn.ctx.TLSState == nil {
+		conn.sendReply(503, "Bad sequence of commands.")
+		return
+	}
+	switch level := strings.ToUpper(args[0]); level {
+	case "C", "P":
+		conn.ctx.Protection = level
 		conn.sendReply(200, "Command okay.")
+	case "S", "E":
+		conn.sendReply(536, "Requested PROT level not supported by mechanism.")
+	default:
+		conn.sendReply(504, "Command not implemented for that parameter.")
 	}
 }
 
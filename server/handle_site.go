@@ -0,0 +1,158 @@
+package server
+
+import (
+	"encoding/hex"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/Charana123/ftp/utils"
+)
+
+// site handles a user 'SITE' control command, dispatching to its subcommands
+func (conn *ftpConnection) site(args []string) {
+	if len(args) == 0 {
+		conn.sendReply(501, "Syntax error in parameters or arguments.")
+		return
+	}
+	switch strings.ToUpper(args[0]) {
+	case "VERIFY":
+		conn.siteVerify(args[1:])
+	case "VERSIONS":
+		conn.siteVersions(args[1:])
+	case "TRASH":
+		conn.siteTrash(args[1:])
+	case "RESTORE":
+		conn.siteRestore(args[1:])
+	default:
+		conn.sendReply(504, "Command not implemented for that parameter.")
+	}
+}
+
+// siteVerify handles the `SITE VERIFY [SHA-256] <hash>` command asserting the SHA-256 hash
+// of the next uploaded file. A file that does not match is quarantined, leaving any file it
+// was to replace untouched, and the upload fails.
+func (conn *ftpConnection) siteVerify(args []string) {
+	if len(args) == 2 && strings.ToUpper(args[0]) == "SHA-256" {
+		args = args[1:]
+	}
+	if len(args) != 1 {
+		conn.sendReply(501, "Syntax error in parameters or arguments.")
+		return
+	}
+	expected := strings.ToLower(args[0])
+	if sum, err := hex.DecodeString(expected); err != nil || len(sum) != 32 {
+		conn.sendReply(501, "Syntax error in parameters or arguments.")
+		return
+	}
+	conn.expectedHash = expected
+	conn.sendReply(200, "Next upload will be verified against SHA-256 "+expected)
+}
+
+// versionedStorage returns the storage keeping versions of `filePath` and the path of the
+// file in it, otherwise replying that the SITE command is unavailable
+func (conn *ftpConnection) versionedStorage(filePath string) (*VersionedStorage, string, bool) {
+	storage, storagePath, ok := conn.findStorage(filePath, func(storage Storage, _ string) bool {
+		_, versioned := storage.(*VersionedStorage)
+		return versioned
+	})
+	if !ok {
+		conn.sendReply(504, "Command not implemented for that parameter.")
+		return nil, "", false
+	}
+	return storage.(*VersionedStorage), storagePath, true
+}
+
+// siteVersions handles the `SITE VERSIONS <path>` command listing the previous and deleted
+// copies of a file, newest first
+func (conn *ftpConnection) siteVersions(args []string) {
+	if len(args) == 0 {
+		conn.sendReply(501, "Syntax error in parameters or arguments.")
+		return
+	}
+	// Arguments are split on spaces, so a path containing spaces spans several of them
+	filePath, err := conn.resolvePath([]string{strings.Join(args, " ")})
+	if notok := utils.HandleWarning(func() {
+		conn.sendReply(553, "Requested action not taken. File name not allowed.")
+	}, err); notok {
+		return
+	}
+	storage, storagePath, ok := conn.versionedStorage(filePath)
+	if !ok {
+		return
+	}
+	versions, err := storage.Versions(storagePath)
+	if notok := utils.HandleWarning(func() {
+		conn.sendReply(451, "Requested action aborted. Local error in processing.")
+	}, err); notok {
+		return
+	}
+	lines := make([]string, 0, len(versions))
+	for _, version := range versions {
+		line := version.ID + " " + strconv.FormatInt(version.Size, 10) + " " + formatFTPTime(version.Time)
+		if version.Deleted {
+			line += " deleted"
+		}
+		lines = append(lines, line)
+	}
+	conn.sendMultilineReply(211, "Versions of "+filePath+":", lines, "End")
+}
+
+// siteTrash handles the `SITE TRASH [<directory>]` command listing the deleted files of a
+// directory that can be restored
+func (conn *ftpConnection) siteTrash(args []string) {
+	dirArgs := []string{}
+	if len(args) > 0 {
+		dirArgs = append(dirArgs, strings.Join(args, " "))
+	}
+	dirPath, err := conn.resolvePath(dirArgs)
+	if notok := utils.HandleWarning(func() {
+		conn.sendReply(553, "Requested action not taken. File name not allowed.")
+	}, err); notok {
+		return
+	}
+	storage, storagePath, ok := conn.versionedStorage(dirPath)
+	if !ok {
+		return
+	}
+	names, err := storage.Trash(storagePath)
+	if notok := utils.HandleWarning(func() {
+		conn.sendReply(451, "Requested action aborted. Local error in processing.")
+	}, err); notok {
+		return
+	}
+	// Only the deleted files the user could access are listed
+	visible := make([]string, 0, len(names))
+	for _, name := range names {
+		if conn.checkAccessControl(path.Join(dirPath, name)) {
+			visible = append(visible, name)
+		}
+	}
+	conn.sendMultilineReply(211, "Deleted files of "+dirPath+":", visible, "End")
+}
+
+// siteRestore handles the `SITE RESTORE <version> <path>` command bringing back a previous
+// or deleted copy of a file listed by SITE VERSIONS
+func (conn *ftpConnection) siteRestore(args []string) {
+	if len(args) < 2 {
+		conn.sendReply(501, "Syntax error in parameters or arguments.")
+		return
+	}
+	filePath, err := conn.resolvePath([]string{strings.Join(args[1:], " ")})
+	if notok := utils.HandleWarning(func() {
+		conn.sendReply(553, "Requested action not taken. File name not allowed.")
+	}, err); notok {
+		return
+	}
+	storage, storagePath, ok := conn.versionedStorage(filePath)
+	if !ok {
+		return
+	}
+	err = storage.Restore(storagePath, args[0])
+	if notok := utils.HandleWarning(func() {
+		conn.sendReply(550, "Requested action not taken. Version unavailable.")
+	}, err); notok {
+		return
+	}
+	conn.sendReply(250, "Restored "+filePath+" from version "+args[0]+".")
+}
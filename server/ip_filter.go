@@ -0,0 +1,118 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+)
+
+var (
+	// ipFiltersLock synchronises access to the IP filters, which may be replaced at runtime
+	ipFiltersLock = &sync.RWMutex{}
+	// globalIPFilter restricts which source IPs may connect to the server
+	globalIPFilter *IPFilter
+	// userIPFilters restricts per username which source IPs may log in
+	userIPFilters map[string]*IPFilter
+)
+
+// IPFilter is a set of CIDR allow and deny rules for source IPs.
+// A denied IP is always rejected, and when allow rules exist an IP must match one of them.
+type IPFilter struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// NewIPFilter creates an IPFilter from CIDR blocks (e.g. "10.0.0.0/8") or single IPs
+func NewIPFilter(allow []string, deny []string) (*IPFilter, error) {
+	allowNets, err := parseCIDRs(allow)
+	if err != nil {
+		return nil, err
+	}
+	denyNets, err := parseCIDRs(deny)
+	if err != nil {
+		return nil, err
+	}
+	return &IPFilter{
+		allow: allowNets,
+		deny:  denyNets,
+	}, nil
+}
+
+// parseCIDRs parses CIDR blocks, treating a single IP as a block containing only itself
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %q", cidr)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, block, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, block)
+	}
+	return nets, nil
+}
+
+// Allows reports whether the filter lets `ip` through. A nil filter allows everything.
+func (f *IPFilter) Allows(ip net.IP) bool {
+	if f == nil {
+		return true
+	}
+	if ip == nil {
+		return false
+	}
+	for _, block := range f.deny {
+		if block.Contains(ip) {
+			return false
+		}
+	}
+	if len(f.allow) == 0 {
+		return true
+	}
+	for _, block := range f.allow {
+		if block.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// SetIPFilter replaces at runtime the filter checked when a connection is accepted
+func SetIPFilter(filter *IPFilter) {
+	ipFiltersLock.Lock()
+	globalIPFilter = filter
+	ipFiltersLock.Unlock()
+}
+
+// SetUserIPFilters replaces at runtime the per username filters checked on login
+func SetUserIPFilters(filters map[string]*IPFilter) {
+	ipFiltersLock.Lock()
+	userIPFilters = filters
+	ipFiltersLock.Unlock()
+}
+
+// connectionAllowed checks the server filter against the source IP of the connection
+func connectionAllowed(ip string) bool {
+	ipFiltersLock.RLock()
+	defer ipFiltersLock.RUnlock()
+	return globalIPFilter.Allows(net.ParseIP(ip))
+}
+
+// loginAllowed checks the filter of `user`, if any, against the source IP of the connection
+func loginAllowed(ip string, user string) bool {
+	ipFiltersLock.RLock()
+	defer ipFiltersLock.RUnlock()
+	return userIPFilters[user].Allows(net.ParseIP(ip))
+}
@@ -0,0 +1,80 @@
+package server
+
+import "log"
+
+var (
+	// openSessions is the number of control connections currently being served
+	openSessions = 0
+	// openSessionsPerIP is the number of control connections currently served per source IP
+	openSessionsPerIP = make(map[string]int)
+	// openLoginsPerUser is the number of sessions currently logged in per username
+	openLoginsPerUser = make(map[string]int)
+)
+
+// connectionLimitMessage returns the message sent with the 421 reply when a connection
+// limit is exceeded
+func connectionLimitMessage() string {
+	if globalServerSettings.ConnectionLimitMessage != "" {
+		return globalServerSettings.ConnectionLimitMessage
+	}
+	return "Too many connections, service not available."
+}
+
+// acquireSession reserves a session slot for a connection from `ip`, returning false if
+// the total or per IP connection limit has been reached
+func acquireSession(ip string) bool {
+	globalLock.Lock()
+	defer globalLock.Unlock()
+	if max := globalServerSettings.MaxConnections; max > 0 && openSessions >= max {
+		log.Println("Rejecting connection from " + ip + ": maximum number of connections reached")
+		return false
+	}
+	if max := globalServerSettings.MaxConnectionsPerIP; max > 0 && openSessionsPerIP[ip] >= max {
+		log.Println("Rejecting connection from " + ip + ": maximum number of connections per IP reached")
+		return false
+	}
+	openSessions++
+	openSessionsPerIP[ip]++
+	return true
+}
+
+// releaseSession frees the session slot held by a connection from `ip`
+func releaseSession(ip string) {
+	globalLock.Lock()
+	defer globalLock.Unlock()
+	openSessions--
+	if openSessionsPerIP[ip]--; openSessionsPerIP[ip] <= 0 {
+		delete(openSessionsPerIP, ip)
+	}
+}
+
+// acquireLogin reserves a login slot for `user`, returning false if the user already
+// has the maximum number of concurrent logins
+func acquireLogin(user string) bool {
+	globalLock.Lock()
+	defer globalLock.Unlock()
+	if max := globalServerSettings.MaxLoginsPerUser; max > 0 && openLoginsPerUser[user] >= max {
+		log.Println("Rejecting login of " + user + ": maximum number of concurrent logins reached")
+		return false
+	}
+	openLoginsPerUser[user]++
+	return true
+}
+
+// releaseLogin frees the login slot held by `user`
+func releaseLogin(user string) {
+	globalLock.Lock()
+	defer globalLock.Unlock()
+	if openLoginsPerUser[user]--; openLoginsPerUser[user] <= 0 {
+		delete(openLoginsPerUser, user)
+	}
+}
+
+// logout frees the login slot held by the connection, if any
+func (conn *ftpConnection) logout() {
+	if conn.loginUser != "" {
+		releaseLogin(conn.loginUser)
+		conn.loginUser = ""
+	}
+	conn.loggedIn = false
+}
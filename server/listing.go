@@ -0,0 +1,158 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// ListFormat selects the format of the directory listings sent in reply to LIST
+type ListFormat int
+
+const (
+	// ListFormatUnix formats entries like `ls -l`
+	ListFormatUnix ListFormat = iota
+	// ListFormatDOS formats entries like the Windows `dir` command (IIS style)
+	ListFormatDOS
+	// ListFormatEPLF formats entries in the Easily Parsed LIST Format
+	ListFormatEPLF
+)
+
+// listOwner returns the owner and group names shown in Unix listings for `fi`.
+// Unless disabled, host user and group IDs are masked with configurable names.
+func listOwner(fi os.FileInfo) (string, string) {
+	if globalServerSettings.ListShowOwner {
+		if uid, gid, ok := fileOwner(fi); ok {
+			return uid, gid
+		}
+	}
+	owner, group := globalServerSettings.ListOwner, globalServerSettings.ListGroup
+	if owner == "" {
+		owner = "ftp"
+	}
+	if group == "" {
+		group = "ftp"
+	}
+	return owner, group
+}
+
+// formatListing formats directory entries in `format`, one CRLF terminated line per entry
+func formatListing(entries []os.FileInfo, format ListFormat) string {
+	var b strings.Builder
+	now := time.Now()
+	for _, fi := range entries {
+		switch format {
+		case ListFormatDOS:
+			b.WriteString(formatDOSEntry(fi))
+		case ListFormatEPLF:
+			b.WriteString(formatEPLFEntry(fi))
+		default:
+			b.WriteString(formatUnixEntry(fi, now))
+		}
+		b.WriteString("\r\n")
+	}
+	return b.String()
+}
+
+// formatUnixEntry formats an entry like `ls -l`, e.g.
+// `-rw-r--r--    1 ftp      ftp          1024 Jan  2 15:04 name`
+func formatUnixEntry(fi os.FileInfo, now time.Time) string {
+	owner, group := listOwner(fi)
+	modTime := fi.ModTime()
+	// Like ls, entries older than six months (or in the future) show the year instead of the time
+	var timestamp string
+	if modTime.After(now.AddDate(0, -6, 0)) && !modTime.After(now) {
+		timestamp = modTime.Format("Jan _2 15:04")
+	} else {
+		timestamp = modTime.Format("Jan _2  2006")
+	}
+	return fmt.Sprintf("%s %4d %-8s %-8s %12d %s %s",
+		unixMode(fi.Mode()), fileLinks(fi), owner, group, fi.Size(), timestamp, fi.Name())
+}
+
+// unixMode formats a file mode as the ten characters shown by `ls -l`, e.g. `drwxr-xr-x`
+func unixMode(mode os.FileMode) string {
+	buf := []byte("----------")
+	switch {
+	case mode.IsDir():
+		buf[0] = 'd'
+	case mode&os.ModeSymlink != 0:
+		buf[0] = 'l'
+	case mode&os.ModeNamedPipe != 0:
+		buf[0] = 'p'
+	case mode&os.ModeSocket != 0:
+		buf[0] = 's'
+	case mode&os.ModeCharDevice != 0:
+		buf[0] = 'c'
+	case mode&os.ModeDevice != 0:
+		buf[0] = 'b'
+	}
+	const rwx = "rwxrwxrwx"
+	for i := 0; i < 9; i++ {
+		if mode&(1<<uint(8-i)) != 0 {
+			buf[i+1] = rwx[i]
+		}
+	}
+	if mode&os.ModeSetuid != 0 {
+		buf[3] = setBit(buf[3], 's')
+	}
+	if mode&os.ModeSetgid != 0 {
+		buf[6] = setBit(buf[6], 's')
+	}
+	if mode&os.ModeSticky != 0 {
+		buf[9] = setBit(buf[9], 't')
+	}
+	return string(buf)
+}
+
+// setBit replaces an execute permission character by the setuid/setgid/sticky character,
+// in upper case when the execute permission is not set
+func setBit(current byte, bit byte) byte {
+	if current == '-' {
+		return bit - 'a' + 'A'
+	}
+	return bit
+}
+
+// formatDOSEntry formats an entry like IIS in MS-DOS mode, e.g.
+// `01-02-06  03:04PM       <DIR>          name`
+func formatDOSEntry(fi os.FileInfo) string {
+	timestamp := fi.ModTime().Format("01-02-06  03:04PM")
+	if fi.IsDir() {
+		return fmt.Sprintf("%s       <DIR>          %s", timestamp, fi.Name())
+	}
+	return fmt.Sprintf("%s %20d %s", timestamp, fi.Size(), fi.Name())
+}
+
+// formatEPLFEntry formats an entry in EPLF (https://cr.yp.to/ftp/list/eplf.html), e.g.
+// `+s1024,m1136214245,r,\tname`
+func formatEPLFEntry(fi os.FileInfo) string {
+	facts := "+"
+	if fi.IsDir() {
+		facts += "/,"
+	} else {
+		facts += "r,s" + fmt.Sprint(fi.Size()) + ","
+	}
+	facts += "m" + fmt.Sprint(fi.ModTime().Unix()) + ","
+	return facts + "\t" + fi.Name()
+}
+
+// formatFacts formats the facts of an entry for MLSD and MLST (RFC 3659), e.g.
+// `type=file;size=1024;modify=20060102150405;perm=rdw;`. The permissions offered are
+// those of the commands the server implements: RETR, DELE and STOR for files, CWD,
+// LIST and STOR for directories.
+func formatFacts(fi os.FileInfo, writable bool) string {
+	if fi.IsDir() {
+		perm := "el"
+		if writable {
+			perm += "c"
+		}
+		return "type=dir;modify=" + formatFTPTime(fi.ModTime()) + ";perm=" + perm + ";"
+	}
+	perm := "r"
+	if writable {
+		perm += "dw"
+	}
+	return "type=file;size=" + fmt.Sprint(fi.Size()) + ";modify=" + formatFTPTime(fi.ModTime()) + ";perm=" + perm + ";"
+}
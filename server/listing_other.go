@@ -0,0 +1,16 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package server
+
+import "os"
+
+// fileOwner is unavailable on platforms without Unix file ownership
+func fileOwner(fi os.FileInfo) (string, string, bool) {
+	return "", "", false
+}
+
+// fileLinks returns 1 on platforms without Unix hard link counts
+func fileLinks(fi os.FileInfo) int {
+	return 1
+}
@@ -0,0 +1,28 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package server
+
+import (
+	"os"
+	"strconv"
+	"syscall"
+)
+
+// fileOwner returns the numeric user and group IDs owning a file
+func fileOwner(fi os.FileInfo) (string, string, bool) {
+	stat, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return "", "", false
+	}
+	return strconv.Itoa(int(stat.Uid)), strconv.Itoa(int(stat.Gid)), true
+}
+
+// fileLinks returns the number of hard links to a file
+func fileLinks(fi os.FileInfo) int {
+	stat, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 1
+	}
+	return int(stat.Nlink)
+}
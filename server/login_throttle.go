@@ -0,0 +1,227 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultFailureWindow is the period during which failed logins are counted unless configured
+	defaultFailureWindow = 10 * time.Minute
+	// maxFailureDelayDoublings bounds the growth of the delay before replying to failed logins
+	maxFailureDelayDoublings = 10
+)
+
+var (
+	// loginFailuresLock synchronises access to the failed login records
+	loginFailuresLock = &sync.Mutex{}
+	// ipLoginFailures records failed logins per source IP
+	ipLoginFailures = make(map[string]*loginFailures)
+	// userLoginFailures records failed logins per username
+	userLoginFailures = make(map[string]*loginFailures)
+	// lastFailuresPrune is when expired failed login records were last dropped
+	lastFailuresPrune = time.Now()
+)
+
+// LoginThrottleSettings configures the protection against password guessing.
+// Zero values disable the corresponding protection.
+type LoginThrottleSettings struct {
+	// Failed logins from one IP within FailureWindow after which the IP is banned
+	MaxFailuresPerIP int
+	// Failed logins of one username within FailureWindow after which the username is banned
+	MaxFailuresPerUser int
+	// Failed logins within one connection after which the connection is closed
+	MaxFailuresPerSession int
+	// Period after the first failure during which failures are counted, 10 minutes if zero
+	FailureWindow time.Duration
+	// How long an IP or username stays banned
+	BanDuration time.Duration
+	// Delay before replying to the first failed login, doubled on each subsequent failure
+	// (up to 1024 times the initial delay)
+	FailureDelay time.Duration
+	// Upper bound of the delay before replying to a failed login
+	MaxFailureDelay time.Duration
+}
+
+// LoginBan describes an IP or a username that is temporarily refused login
+type LoginBan struct {
+	IP    string // Banned source IP, empty for a username ban
+	User  string // Banned username, empty for an IP ban
+	Until time.Time
+}
+
+// loginFailures counts the failed logins of one IP or username
+type loginFailures struct {
+	count       int
+	firstFailed time.Time
+	bannedUntil time.Time
+}
+
+// failureWindow returns the period after the first failure during which failures are counted
+func failureWindow() time.Duration {
+	if window := globalServerSettings.LoginThrottle.FailureWindow; window > 0 {
+		return window
+	}
+	return defaultFailureWindow
+}
+
+// recordFailure counts a failed login and bans the key once `max` is reached,
+// returning true if a new ban was applied
+func recordFailure(records map[string]*loginFailures, key string, max int) bool {
+	settings := globalServerSettings.LoginThrottle
+	now := time.Now()
+	record, ok := records[key]
+	if !ok {
+		record = &loginFailures{firstFailed: now}
+		records[key] = record
+	} else if now.Sub(record.firstFailed) > failureWindow() {
+		// Start a new failure window
+		record.count = 0
+		record.firstFailed = now
+	}
+	record.count++
+	if max > 0 && record.count >= max && settings.BanDuration > 0 && now.After(record.bannedUntil) {
+		record.bannedUntil = now.Add(settings.BanDuration)
+		return true
+	}
+	return false
+}
+
+// isBanned reports whether the key has an active ban
+func isBanned(records map[string]*loginFailures, key string) bool {
+	record, ok := records[key]
+	return ok && time.Now().Before(record.bannedUntil)
+}
+
+// loginBanned reports whether logins from `ip` or as `user` are currently banned
+func loginBanned(ip string, user string) bool {
+	loginFailuresLock.Lock()
+	defer loginFailuresLock.Unlock()
+	return isBanned(ipLoginFailures, ip) || isBanned(userLoginFailures, user)
+}
+
+// loginFailed records a failed login from `ip` as `user`, applying any resulting bans,
+// and returns how long to wait before replying
+func (conn *ftpConnection) loginFailed(ip string, user string) time.Duration {
+	settings := globalServerSettings.LoginThrottle
+	banIPs := settings.MaxFailuresPerIP > 0 && settings.BanDuration > 0
+	banUsers := settings.MaxFailuresPerUser > 0 && settings.BanDuration > 0
+	// Failures are only remembered for the protections counting them, as any client can
+	// make up usernames
+	if !banIPs && !banUsers && settings.FailureDelay <= 0 {
+		return 0
+	}
+
+	loginFailuresLock.Lock()
+	if now := time.Now(); now.Sub(lastFailuresPrune) > time.Minute {
+		pruneFailures(ipLoginFailures, now)
+		pruneFailures(userLoginFailures, now)
+		lastFailuresPrune = now
+	}
+	ipBanned, userBanned, failures := false, false, 0
+	if banIPs || settings.FailureDelay > 0 {
+		ipBanned = recordFailure(ipLoginFailures, ip, settings.MaxFailuresPerIP)
+		failures = ipLoginFailures[ip].count
+	}
+	if banUsers {
+		userBanned = recordFailure(userLoginFailures, user, settings.MaxFailuresPerUser)
+	}
+	loginFailuresLock.Unlock()
+
+	if ipBanned {
+		emitEvent(Event{
+			Kind:     EventLoginBan,
+			RemoteIP: ip,
+			Message:  fmt.Sprintf("IP %s banned for %s after %d failed logins", ip, settings.BanDuration, failures),
+			Session:  conn.ctx,
+		})
+	}
+	if userBanned {
+		emitEvent(Event{
+			Kind:     EventLoginBan,
+			RemoteIP: ip,
+			User:     user,
+			Message:  fmt.Sprintf("User %s banned for %s after repeated failed logins", user, settings.BanDuration),
+			Session:  conn.ctx,
+		})
+	}
+
+	if settings.FailureDelay <= 0 {
+		return 0
+	}
+	delay := settings.FailureDelay
+	for i := 1; i < failures && i <= maxFailureDelayDoublings; i++ {
+		delay *= 2
+		if settings.MaxFailureDelay > 0 && delay >= settings.MaxFailureDelay {
+			return settings.MaxFailureDelay
+		}
+	}
+	return delay
+}
+
+// resetFailures forgets the failed logins of the key, keeping any active ban
+func resetFailures(records map[string]*loginFailures, key string) {
+	if record, ok := records[key]; ok {
+		if time.Now().Before(record.bannedUntil) {
+			record.count = 0
+		} else {
+			delete(records, key)
+		}
+	}
+}
+
+// loginSucceeded forgets the failed logins of `ip` and `user` (but not their bans)
+func loginSucceeded(ip string, user string) {
+	loginFailuresLock.Lock()
+	resetFailures(ipLoginFailures, ip)
+	resetFailures(userLoginFailures, user)
+	loginFailuresLock.Unlock()
+}
+
+// pruneFailures drops the records whose failure window and ban have both expired
+func pruneFailures(records map[string]*loginFailures, now time.Time) {
+	window := failureWindow()
+	for key, record := range records {
+		if now.Sub(record.firstFailed) > window && now.After(record.bannedUntil) {
+			delete(records, key)
+		}
+	}
+}
+
+// LoginBans returns the currently active login bans
+func LoginBans() []LoginBan {
+	loginFailuresLock.Lock()
+	defer loginFailuresLock.Unlock()
+	bans := make([]LoginBan, 0)
+	now := time.Now()
+	for ip, record := range ipLoginFailures {
+		if now.Before(record.bannedUntil) {
+			bans = append(bans, LoginBan{IP: ip, Until: record.bannedUntil})
+		}
+	}
+	for user, record := range userLoginFailures {
+		if now.Before(record.bannedUntil) {
+			bans = append(bans, LoginBan{User: user, Until: record.bannedUntil})
+		}
+	}
+	sort.Slice(bans, func(i, j int) bool {
+		return bans[i].Until.Before(bans[j].Until)
+	})
+	return bans
+}
+
+// ClearIPBan lifts the ban and forgets the failed logins of a source IP
+func ClearIPBan(ip string) {
+	loginFailuresLock.Lock()
+	delete(ipLoginFailures, ip)
+	loginFailuresLock.Unlock()
+}
+
+// ClearUserBan lifts the ban and forgets the failed logins of a username
+func ClearUserBan(user string) {
+	loginFailuresLock.Lock()
+	delete(userLoginFailures, user)
+	loginFailuresLock.Unlock()
+}
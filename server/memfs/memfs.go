@@ -0,0 +1,530 @@
+// Package memfs is an in-memory filesystem usable as the storage of the FTP server, so that
+// code built on the server can be exercised over the full protocol without touching disk.
+// Failures such as a full disk, denied permissions or slow reads can be injected.
+package memfs
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrDiskFull is returned by writes exceeding the capacity of the filesystem
+var ErrDiskFull = errors.New("no space left on device")
+
+// Op names an operation of the filesystem for failure injection
+type Op string
+
+// Operations of a FS
+const (
+	OpStat    Op = "stat"
+	OpReadDir Op = "readdir"
+	OpOpen    Op = "open"
+	OpRead    Op = "read"
+	OpCreate  Op = "create"
+	OpWrite   Op = "write"
+	OpRemove  Op = "remove"
+	OpRename  Op = "rename"
+	OpMkdir   Op = "mkdir"
+	OpChtimes Op = "chtimes"
+)
+
+// Faults are the failures injected into the operations of a FS
+type Faults struct {
+	// Bytes of file contents the filesystem holds before writes fail with ErrDiskFull,
+	// unlimited if zero
+	Capacity int64
+	// Delay of every read of file contents
+	ReadDelay time.Duration
+	// Delay of every write of file contents
+	WriteDelay time.Duration
+	// Fail returns the error an operation on a path fails with, or nil to let it proceed.
+	// Reads and writes are checked on every call.
+	Fail func(op Op, path string) error
+}
+
+// node is a file or directory
+type node struct {
+	mode     os.FileMode // Permission bits, with os.ModeDir for directories
+	modTime  time.Time
+	data     []byte
+	children map[string]*node
+	unlinked bool // Whether the file was removed or replaced, so its contents no longer count as used
+}
+
+// FS is an in-memory filesystem implementing the server's Storage interface. Paths are
+// absolute and slash separated. It is safe for concurrent use.
+type FS struct {
+	lock   sync.RWMutex
+	root   *node
+	used   int64 // Bytes of file contents held
+	faults Faults
+}
+
+// New creates an empty FS
+func New() *FS {
+	return &FS{root: newDir(0777)}
+}
+
+func newDir(perm os.FileMode) *node {
+	return &node{mode: os.ModeDir | perm, modTime: time.Now(), children: make(map[string]*node)}
+}
+
+// SetFaults replaces the failures injected into later operations
+func (fs *FS) SetFaults(faults Faults) {
+	fs.lock.Lock()
+	fs.faults = faults
+	fs.lock.Unlock()
+}
+
+// Used returns the bytes of file contents held by the filesystem
+func (fs *FS) Used() int64 {
+	fs.lock.RLock()
+	defer fs.lock.RUnlock()
+	return fs.used
+}
+
+// fail returns the error injected into an operation, if any
+func (fs *FS) fail(op Op, name string) error {
+	fs.lock.RLock()
+	fail := fs.faults.Fail
+	fs.lock.RUnlock()
+	if fail == nil {
+		return nil
+	}
+	if err := fail(op, name); err != nil {
+		return &os.PathError{Op: string(op), Path: name, Err: err}
+	}
+	return nil
+}
+
+// split returns the elements of a path, none for the root
+func split(name string) []string {
+	name = path.Clean("/" + name)
+	if name == "/" {
+		return nil
+	}
+	return strings.Split(name[1:], "/")
+}
+
+// lookup returns the node at a path, with fs.lock held
+func (fs *FS) lookup(op Op, name string) (*node, error) {
+	current := fs.root
+	for _, element := range split(name) {
+		if !current.mode.IsDir() {
+			return nil, &os.PathError{Op: string(op), Path: name, Err: errors.New("not a directory")}
+		}
+		if current.mode&0100 == 0 {
+			return nil, &os.PathError{Op: string(op), Path: name, Err: os.ErrPermission}
+		}
+		child, ok := current.children[element]
+		if !ok {
+			return nil, &os.PathError{Op: string(op), Path: name, Err: os.ErrNotExist}
+		}
+		current = child
+	}
+	return current, nil
+}
+
+// lookupParent returns the writable directory holding a path and the name of the path in
+// it, with fs.lock held
+func (fs *FS) lookupParent(op Op, name string) (*node, string, error) {
+	elements := split(name)
+	if len(elements) == 0 {
+		return nil, "", &os.PathError{Op: string(op), Path: name, Err: os.ErrInvalid}
+	}
+	parent, err := fs.lookup(op, "/"+strings.Join(elements[:len(elements)-1], "/"))
+	if err != nil {
+		return nil, "", err
+	}
+	if !parent.mode.IsDir() {
+		return nil, "", &os.PathError{Op: string(op), Path: name, Err: errors.New("not a directory")}
+	}
+	if parent.mode&0200 == 0 {
+		return nil, "", &os.PathError{Op: string(op), Path: name, Err: os.ErrPermission}
+	}
+	return parent, elements[len(elements)-1], nil
+}
+
+// Stat returns information about a file or directory
+func (fs *FS) Stat(name string) (os.FileInfo, error) {
+	if err := fs.fail(OpStat, name); err != nil {
+		return nil, err
+	}
+	fs.lock.RLock()
+	defer fs.lock.RUnlock()
+	n, err := fs.lookup(OpStat, name)
+	if err != nil {
+		return nil, err
+	}
+	return newFileInfo(path.Base(path.Clean("/"+name)), n), nil
+}
+
+// ReadDir returns the entries of a directory sorted by name
+func (fs *FS) ReadDir(name string) ([]os.FileInfo, error) {
+	if err := fs.fail(OpReadDir, name); err != nil {
+		return nil, err
+	}
+	fs.lock.RLock()
+	defer fs.lock.RUnlock()
+	n, err := fs.lookup(OpReadDir, name)
+	if err != nil {
+		return nil, err
+	}
+	if !n.mode.IsDir() {
+		return nil, &os.PathError{Op: string(OpReadDir), Path: name, Err: errors.New("not a directory")}
+	}
+	if n.mode&0400 == 0 {
+		return nil, &os.PathError{Op: string(OpReadDir), Path: name, Err: os.ErrPermission}
+	}
+	infos := make([]os.FileInfo, 0, len(n.children))
+	for childName, child := range n.children {
+		infos = append(infos, newFileInfo(childName, child))
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+	return infos, nil
+}
+
+// Open opens a file for reading from `offset`
+func (fs *FS) Open(name string, offset int64) (io.ReadCloser, error) {
+	if err := fs.fail(OpOpen, name); err != nil {
+		return nil, err
+	}
+	fs.lock.RLock()
+	defer fs.lock.RUnlock()
+	n, err := fs.lookup(OpOpen, name)
+	if err != nil {
+		return nil, err
+	}
+	if n.mode.IsDir() {
+		return nil, &os.PathError{Op: string(OpOpen), Path: name, Err: errors.New("is a directory")}
+	}
+	if n.mode&0400 == 0 {
+		return nil, &os.PathError{Op: string(OpOpen), Path: name, Err: os.ErrPermission}
+	}
+	return &reader{fs: fs, name: name, node: n, offset: offset}, nil
+}
+
+// Create opens a file for writing from `offset`, creating it if needed and discarding its
+// contents from `offset` on
+func (fs *FS) Create(name string, offset int64) (io.WriteCloser, error) {
+	if err := fs.fail(OpCreate, name); err != nil {
+		return nil, err
+	}
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	n, err := fs.lookup(OpCreate, name)
+	if os.IsNotExist(err) {
+		parent, base, err := fs.lookupParent(OpCreate, name)
+		if err != nil {
+			return nil, err
+		}
+		n = &node{mode: 0666, modTime: time.Now()}
+		parent.children[base] = n
+		parent.modTime = n.modTime
+	} else if err != nil {
+		return nil, err
+	} else if n.mode.IsDir() {
+		return nil, &os.PathError{Op: string(OpCreate), Path: name, Err: errors.New("is a directory")}
+	} else if n.mode&0200 == 0 {
+		return nil, &os.PathError{Op: string(OpCreate), Path: name, Err: os.ErrPermission}
+	}
+	if offset < int64(len(n.data)) {
+		fs.used -= int64(len(n.data)) - offset
+		n.data = n.data[:offset]
+	} else if offset > int64(len(n.data)) {
+		return nil, &os.PathError{Op: string(OpCreate), Path: name, Err: os.ErrInvalid}
+	}
+	n.modTime = time.Now()
+	return &writer{fs: fs, name: name, node: n}, nil
+}
+
+// Remove deletes a file or an empty directory
+func (fs *FS) Remove(name string) error {
+	if err := fs.fail(OpRemove, name); err != nil {
+		return err
+	}
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	parent, base, err := fs.lookupParent(OpRemove, name)
+	if err != nil {
+		return err
+	}
+	n, ok := parent.children[base]
+	if !ok {
+		return &os.PathError{Op: string(OpRemove), Path: name, Err: os.ErrNotExist}
+	}
+	if n.mode.IsDir() && len(n.children) > 0 {
+		return &os.PathError{Op: string(OpRemove), Path: name, Err: errors.New("directory not empty")}
+	}
+	delete(parent.children, base)
+	parent.modTime = time.Now()
+	fs.used -= int64(len(n.data))
+	n.unlinked = true
+	return nil
+}
+
+// Rename moves a file or directory, replacing any file at the destination
+func (fs *FS) Rename(from string, to string) error {
+	if err := fs.fail(OpRename, from); err != nil {
+		return err
+	}
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	fromParent, fromBase, err := fs.lookupParent(OpRename, from)
+	if err != nil {
+		return err
+	}
+	n, ok := fromParent.children[fromBase]
+	if !ok {
+		return &os.PathError{Op: string(OpRename), Path: from, Err: os.ErrNotExist}
+	}
+	toParent, toBase, err := fs.lookupParent(OpRename, to)
+	if err != nil {
+		return err
+	}
+	cleanFrom, cleanTo := path.Clean("/"+from), path.Clean("/"+to)
+	if cleanFrom == cleanTo {
+		return nil
+	}
+	// A directory cannot be moved into itself
+	if n.mode.IsDir() && strings.HasPrefix(cleanTo+"/", cleanFrom+"/") {
+		return &os.PathError{Op: string(OpRename), Path: to, Err: os.ErrInvalid}
+	}
+	if existing, ok := toParent.children[toBase]; ok {
+		if existing.mode.IsDir() {
+			return &os.PathError{Op: string(OpRename), Path: to, Err: os.ErrExist}
+		}
+		fs.used -= int64(len(existing.data))
+		existing.unlinked = true
+	}
+	delete(fromParent.children, fromBase)
+	toParent.children[toBase] = n
+	now := time.Now()
+	fromParent.modTime, toParent.modTime = now, now
+	return nil
+}
+
+// Mkdir creates a directory
+func (fs *FS) Mkdir(name string) error {
+	if err := fs.fail(OpMkdir, name); err != nil {
+		return err
+	}
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	return fs.mkdir(name, 0777)
+}
+
+// mkdir creates a directory, with fs.lock held
+func (fs *FS) mkdir(name string, perm os.FileMode) error {
+	parent, base, err := fs.lookupParent(OpMkdir, name)
+	if err != nil {
+		return err
+	}
+	if _, ok := parent.children[base]; ok {
+		return &os.PathError{Op: string(OpMkdir), Path: name, Err: os.ErrExist}
+	}
+	dir := newDir(perm)
+	parent.children[base] = dir
+	parent.modTime = dir.modTime
+	return nil
+}
+
+// Chtimes sets the modification time of a file or directory
+func (fs *FS) Chtimes(name string, modTime time.Time) error {
+	if err := fs.fail(OpChtimes, name); err != nil {
+		return err
+	}
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	n, err := fs.lookup(OpChtimes, name)
+	if err != nil {
+		return err
+	}
+	n.modTime = modTime
+	return nil
+}
+
+// MkdirAll creates a directory along with any missing parents, without injected failures
+func (fs *FS) MkdirAll(name string, perm os.FileMode) error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	current := "/"
+	for _, element := range split(name) {
+		current = path.Join(current, element)
+		n, err := fs.lookup(OpMkdir, current)
+		if os.IsNotExist(err) {
+			if err := fs.mkdir(current, perm); err != nil {
+				return err
+			}
+			continue
+		} else if err != nil {
+			return err
+		}
+		if !n.mode.IsDir() {
+			return &os.PathError{Op: string(OpMkdir), Path: current, Err: errors.New("not a directory")}
+		}
+	}
+	return nil
+}
+
+// WriteFile creates or replaces a file with the given contents and permissions, without
+// injected failures or capacity limits, creating its parent directories if needed
+func (fs *FS) WriteFile(name string, data []byte, perm os.FileMode) error {
+	if err := fs.MkdirAll(path.Dir(path.Clean("/"+name)), 0777); err != nil {
+		return err
+	}
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	parent, base, err := fs.lookupParent(OpCreate, name)
+	if err != nil {
+		return err
+	}
+	if existing, ok := parent.children[base]; ok {
+		if existing.mode.IsDir() {
+			return &os.PathError{Op: string(OpCreate), Path: name, Err: errors.New("is a directory")}
+		}
+		fs.used -= int64(len(existing.data))
+		existing.unlinked = true
+	}
+	n := &node{mode: perm.Perm(), modTime: time.Now(), data: append([]byte{}, data...)}
+	parent.children[base] = n
+	parent.modTime = n.modTime
+	fs.used += int64(len(data))
+	return nil
+}
+
+// ReadFile returns the contents of a file, without injected failures
+func (fs *FS) ReadFile(name string) ([]byte, error) {
+	fs.lock.RLock()
+	defer fs.lock.RUnlock()
+	n, err := fs.lookup(OpOpen, name)
+	if err != nil {
+		return nil, err
+	}
+	if n.mode.IsDir() {
+		return nil, &os.PathError{Op: string(OpOpen), Path: name, Err: errors.New("is a directory")}
+	}
+	return append([]byte{}, n.data...), nil
+}
+
+// Chmod sets the permissions of a file or directory. Files without read permission cannot
+// be opened, without write permission cannot be overwritten, and directories without write
+// permission cannot have entries added or removed.
+func (fs *FS) Chmod(name string, perm os.FileMode) error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	n, err := fs.lookup(OpChtimes, name)
+	if err != nil {
+		return err
+	}
+	n.mode = n.mode&os.ModeDir | perm.Perm()
+	return nil
+}
+
+// reader reads the contents of a file from an offset. Contents written meanwhile are seen.
+type reader struct {
+	fs     *FS
+	name   string
+	node   *node
+	offset int64
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	if err := r.fs.fail(OpRead, r.name); err != nil {
+		return 0, err
+	}
+	r.fs.lock.RLock()
+	delay := r.fs.faults.ReadDelay
+	r.fs.lock.RUnlock()
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+	r.fs.lock.RLock()
+	defer r.fs.lock.RUnlock()
+	if r.offset >= int64(len(r.node.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, r.node.data[r.offset:])
+	r.offset += int64(n)
+	return n, nil
+}
+
+func (r *reader) Close() error {
+	return nil
+}
+
+// writer appends to the contents of a file, up to the capacity of the filesystem
+type writer struct {
+	fs     *FS
+	name   string
+	node   *node
+	closed bool
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, &os.PathError{Op: string(OpWrite), Path: w.name, Err: os.ErrClosed}
+	}
+	if err := w.fs.fail(OpWrite, w.name); err != nil {
+		return 0, err
+	}
+	w.fs.lock.RLock()
+	delay := w.fs.faults.WriteDelay
+	w.fs.lock.RUnlock()
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+	w.fs.lock.Lock()
+	defer w.fs.lock.Unlock()
+	if w.node.unlinked {
+		// Contents of a removed or replaced file are dropped along with the writer
+		w.node.data = append(w.node.data, p...)
+		return len(p), nil
+	}
+	var err error
+	if capacity := w.fs.faults.Capacity; capacity > 0 && w.fs.used+int64(len(p)) > capacity {
+		room := capacity - w.fs.used
+		if room < 0 {
+			room = 0
+		}
+		p = p[:room]
+		err = &os.PathError{Op: string(OpWrite), Path: w.name, Err: ErrDiskFull}
+	}
+	w.node.data = append(w.node.data, p...)
+	w.node.modTime = time.Now()
+	w.fs.used += int64(len(p))
+	return len(p), err
+}
+
+func (w *writer) Close() error {
+	if w.closed {
+		return &os.PathError{Op: "close", Path: w.name, Err: os.ErrClosed}
+	}
+	w.closed = true
+	return nil
+}
+
+// fileInfo is a snapshot of a node implementing os.FileInfo
+type fileInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func newFileInfo(name string, n *node) *fileInfo {
+	return &fileInfo{name: name, size: int64(len(n.data)), mode: n.mode, modTime: n.modTime}
+}
+
+func (fi *fileInfo) Name() string       { return fi.name }
+func (fi *fileInfo) Size() int64        { return fi.size }
+func (fi *fileInfo) Mode() os.FileMode  { return fi.mode }
+func (fi *fileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *fileInfo) IsDir() bool        { return fi.mode.IsDir() }
+func (fi *fileInfo) Sys() interface{}   { return nil }
@@ -0,0 +1,355 @@
+package memfs
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/Charana123/ftp/server"
+)
+
+var _ server.Storage = (*FS)(nil)
+
+// write creates a file with the given contents through the Storage interface
+func write(fs *FS, name string, data string) error {
+	w, err := fs.Create(name, 0)
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, data); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+func read(t *testing.T, fs *FS, name string, offset int64) string {
+	t.Helper()
+	r, err := fs.Open(name, offset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestCreateAndOpen(t *testing.T) {
+	fs := New()
+	if err := fs.Mkdir("/dir"); err != nil {
+		t.Fatal(err)
+	}
+	if err := write(fs, "/dir/file", "hello world"); err != nil {
+		t.Fatal(err)
+	}
+	if got := read(t, fs, "/dir/file", 6); got != "world" {
+		t.Errorf("Open from 6 = %q", got)
+	}
+	info, err := fs.Stat("/dir/file")
+	if err != nil || info.Size() != 11 || info.IsDir() || info.Name() != "file" {
+		t.Errorf("Stat = %+v, %v", info, err)
+	}
+	infos, err := fs.ReadDir("/dir")
+	if err != nil || len(infos) != 1 || infos[0].Name() != "file" {
+		t.Errorf("ReadDir = %v, %v", infos, err)
+	}
+
+	// Writing from an offset keeps the contents before it
+	w, err := fs.Create("/dir/file", 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(w, ", there")
+	w.Close()
+	if got := read(t, fs, "/dir/file", 0); got != "hello, there" {
+		t.Errorf("resumed file = %q", got)
+	}
+	if _, err := fs.Create("/dir/file", 100); err == nil {
+		t.Error("Create beyond the end succeeded")
+	}
+	if fs.Used() != int64(len("hello, there")) {
+		t.Errorf("Used = %d", fs.Used())
+	}
+
+	if _, err := fs.Open("/missing", 0); !os.IsNotExist(err) {
+		t.Errorf("Open(missing) = %v", err)
+	}
+	if err := fs.Remove("/dir"); err == nil {
+		t.Error("Remove of a non-empty directory succeeded")
+	}
+}
+
+func TestCapacity(t *testing.T) {
+	fs := New()
+	fs.SetFaults(Faults{Capacity: 10})
+	if err := write(fs, "/a", "123456"); err != nil {
+		t.Fatal(err)
+	}
+	err := write(fs, "/b", "123456")
+	if !errors.Is(err, ErrDiskFull) {
+		t.Fatalf("write beyond capacity = %v", err)
+	}
+	if got := read(t, fs, "/b", 0); got != "1234" {
+		t.Errorf("partial file = %q", got)
+	}
+	if fs.Used() != 10 {
+		t.Errorf("Used = %d, want 10", fs.Used())
+	}
+	// Removing files frees their space
+	if err := fs.Remove("/a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := write(fs, "/c", "123456"); err != nil {
+		t.Errorf("write after remove = %v", err)
+	}
+}
+
+func TestRenameAccounting(t *testing.T) {
+	fs := New()
+	write(fs, "/a", "12345")
+	write(fs, "/b", "123")
+	// Renaming a file onto itself changes nothing
+	for _, name := range []string{"/a", "/./a", "//a"} {
+		if err := fs.Rename("/a", name); err != nil {
+			t.Fatalf("Rename(/a, %s) = %v", name, err)
+		}
+	}
+	if got := read(t, fs, "/a", 0); got != "12345" || fs.Used() != 8 {
+		t.Errorf("after renaming onto itself: %q, Used = %d", got, fs.Used())
+	}
+	// Replacing a file frees its space
+	if err := fs.Rename("/a", "/b"); err != nil {
+		t.Fatal(err)
+	}
+	if fs.Used() != 5 {
+		t.Errorf("Used = %d, want 5", fs.Used())
+	}
+	if _, err := fs.Stat("/a"); !os.IsNotExist(err) {
+		t.Errorf("Stat(/a) = %v", err)
+	}
+
+	fs.Mkdir("/dir")
+	if err := fs.Rename("/dir", "/dir/sub"); err == nil {
+		t.Error("moving a directory into itself succeeded")
+	}
+	if err := fs.Rename("/b", "/dir"); err == nil {
+		t.Error("replacing a directory succeeded")
+	}
+}
+
+func TestUnlinkedWriter(t *testing.T) {
+	for name, unlink := range map[string]func(fs *FS) error{
+		"remove":    func(fs *FS) error { return fs.Remove("/file") },
+		"rename":    func(fs *FS) error { return fs.Rename("/other", "/file") },
+		"writefile": func(fs *FS) error { return fs.WriteFile("/file", []byte("xy"), 0666) },
+	} {
+		fs := New()
+		write(fs, "/other", "xy")
+		w, err := fs.Create("/file", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(w, "abc")
+		if err := unlink(fs); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		before := fs.Used()
+		// Writes to a file no longer in the tree take no space
+		if _, err := io.WriteString(w, "defgh"); err != nil {
+			t.Errorf("%s: write = %v", name, err)
+		}
+		w.Close()
+		if fs.Used() != before {
+			t.Errorf("%s: Used = %d after writing to an unlinked file, want %d", name, fs.Used(), before)
+		}
+	}
+}
+
+func TestFaults(t *testing.T) {
+	fs := New()
+	write(fs, "/file", "data")
+	injected := errors.New("injected")
+	fs.SetFaults(Faults{Fail: func(op Op, name string) error {
+		if op == OpRead || op == OpRemove {
+			return injected
+		}
+		return nil
+	}})
+	r, err := fs.Open("/file", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(r); !errors.Is(err, injected) {
+		t.Errorf("read = %v", err)
+	}
+	if err := fs.Remove("/file"); !errors.Is(err, injected) {
+		t.Errorf("Remove = %v", err)
+	}
+	if _, err := fs.Stat("/file"); err != nil {
+		t.Errorf("Stat = %v", err)
+	}
+}
+
+func TestPermissions(t *testing.T) {
+	fs := New()
+	fs.WriteFile("/dir/secret", []byte("s"), 0)
+	if _, err := fs.Open("/dir/secret", 0); !os.IsPermission(err) {
+		t.Errorf("Open of an unreadable file = %v", err)
+	}
+	if _, err := fs.Create("/dir/secret", 0); !os.IsPermission(err) {
+		t.Errorf("Create over a read-only file = %v", err)
+	}
+	fs.Chmod("/dir", 0555)
+	if err := write(fs, "/dir/new", "n"); !os.IsPermission(err) {
+		t.Errorf("Create in a read-only directory = %v", err)
+	}
+	if err := fs.Remove("/dir/secret"); !os.IsPermission(err) {
+		t.Errorf("Remove from a read-only directory = %v", err)
+	}
+	fs.Chmod("/dir", 0666)
+	if _, err := fs.Stat("/dir/secret"); !os.IsPermission(err) {
+		t.Errorf("Stat through an unsearchable directory = %v", err)
+	}
+}
+
+// testDriver serves a FS to any user logging in with the password "pw"
+type testDriver struct {
+	fs *FS
+}
+
+func (d testDriver) Welcome(ctx *server.UserContext) (string, error) { return "Welcome", nil }
+func (d testDriver) Bye(ctx *server.UserContext) (string, error)     { return "Bye", nil }
+func (d testDriver) AuthUser(ctx *server.UserContext, user string, pass string) (bool, error) {
+	return pass == "pw", nil
+}
+func (d testDriver) GetSettings() (*server.ServerSettings, error) {
+	ports, err := server.NewPortRange(40000, 40019)
+	if err != nil {
+		return nil, err
+	}
+	return &server.ServerSettings{PublicDirectory: "/", Storage: d.fs, PublicIP: "127.0.0.1", DataPortRange: ports}, nil
+}
+func (d testDriver) GetAccessControlSettings() (map[string][]string, error) {
+	return map[string][]string{"all": {"/"}}, nil
+}
+func (d testDriver) GetTLSConfig() (*tls.Config, error) { return nil, nil }
+
+// client is the control connection of a test client
+type client struct {
+	t *testing.T
+	*textproto.Conn
+}
+
+// cmd sends a command and checks the code of its reply
+func (c *client) cmd(code int, format string, args ...interface{}) string {
+	c.t.Helper()
+	if _, err := c.Cmd(format, args...); err != nil {
+		c.t.Fatal(err)
+	}
+	_, message, err := c.ReadResponse(code)
+	if err != nil {
+		c.t.Fatalf("%s: %v", strings.Fields(format)[0], err)
+	}
+	return message
+}
+
+// pasv opens a passive data connection
+func (c *client) pasv() net.Conn {
+	c.t.Helper()
+	// The data port is the last two numbers of (h1,h2,h3,h4,p1,p2)
+	fields := strings.Split(strings.Trim(c.cmd(227, "PASV")[len("Entering Passive Mode "):], "()"), ",")
+	high, _ := strconv.Atoi(fields[4])
+	low, _ := strconv.Atoi(fields[5])
+	conn, err := net.Dial("tcp4", net.JoinHostPort("127.0.0.1", strconv.Itoa(high*256+low)))
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return conn
+}
+
+// transfer runs a command over a passive data connection, sending `data` unless nil and
+// returning what was received
+func (c *client) transfer(data []byte, format string, args ...interface{}) []byte {
+	c.t.Helper()
+	conn := c.pasv()
+	c.cmd(125, format, args...)
+	var received []byte
+	var err error
+	if data != nil {
+		_, err = conn.Write(data)
+	} else {
+		received, err = ioutil.ReadAll(conn)
+	}
+	conn.Close()
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if _, _, err := c.ReadResponse(226); err != nil {
+		c.t.Fatalf("%s: %v", strings.Fields(format)[0], err)
+	}
+	return received
+}
+
+func TestProtocol(t *testing.T) {
+	fs := New()
+	fs.WriteFile("/docs/readme.txt", []byte("read me"), 0644)
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go server.Serve(listener, testDriver{fs})
+
+	conn, err := textproto.Dial("tcp4", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	c := &client{t, conn}
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+	c.cmd(530, "PWD")
+	c.cmd(331, "USER alice")
+	c.cmd(230, "PASS pw")
+	c.cmd(200, "TYPE I")
+
+	c.transfer([]byte("uploaded over FTP"), "STOR upload.txt")
+	if got := read(t, fs, "/upload.txt", 0); got != "uploaded over FTP" {
+		t.Errorf("stored file = %q", got)
+	}
+	if got := c.transfer(nil, "RETR docs/readme.txt"); string(got) != "read me" {
+		t.Errorf("RETR = %q", got)
+	}
+	c.cmd(350, "REST 9")
+	if got := c.transfer(nil, "RETR upload.txt"); string(got) != "over FTP" {
+		t.Errorf("RETR from 9 = %q", got)
+	}
+	listing := strings.Split(strings.TrimSpace(string(c.transfer(nil, "LIST"))), "\r\n")
+	if len(listing) != 2 || listing[0][0] != 'd' || !strings.HasSuffix(listing[0], " docs") ||
+		!strings.Contains(listing[1], " 17 ") || !strings.HasSuffix(listing[1], " upload.txt") {
+		t.Errorf("LIST = %q", listing)
+	}
+	c.cmd(213, "SIZE upload.txt")
+
+	// Failures injected into the storage reach the client
+	fs.SetFaults(Faults{Capacity: fs.Used() + 4})
+	data := c.pasv()
+	c.cmd(125, "STOR full.txt")
+	data.Write([]byte("more than four bytes"))
+	data.Close()
+	if _, _, err := c.ReadResponse(451); err != nil {
+		t.Errorf("STOR beyond capacity: %v", err)
+	}
+	c.cmd(221, "QUIT")
+}
@@ -0,0 +1,145 @@
+package server
+
+import (
+	"errors"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// OverwritePolicy decides what a STOR naming an existing file does
+type OverwritePolicy int
+
+const (
+	// OverwriteAllow replaces the existing file
+	OverwriteAllow OverwritePolicy = iota
+	// OverwriteRefuse fails the upload, leaving the existing file untouched
+	OverwriteRefuse
+	// OverwriteRename stores the upload under a unique name, as STOU does
+	OverwriteRename
+)
+
+// OverwritePolicyDriver is optionally implemented by a ServerDriver to protect existing
+// files from being overwritten, for instance in drop directories shared by several users
+type OverwritePolicyDriver interface {
+	// GetOverwritePolicy returns the policy applied to uploads in the directory `dir`
+	GetOverwritePolicy(ctx *UserContext, dir string) (OverwritePolicy, error)
+}
+
+// maxUniqueNameAttempts bounds the search for a unused file name
+const maxUniqueNameAttempts = 1000
+
+// errFileExists is returned when an upload would overwrite a file its directory protects
+var errFileExists = errors.New("File already exists")
+
+// reservedUploadPaths are the paths of files being uploaded under a name that must not be
+// taken by another upload, guarded by globalLock
+var reservedUploadPaths = make(map[string]bool)
+
+// overwritePolicy returns the policy applied to uploads in the directory `dir`
+func (conn *ftpConnection) overwritePolicy(dir string) (OverwritePolicy, error) {
+	if policyDriver, ok := globalDriver.(OverwritePolicyDriver); ok {
+		return policyDriver.GetOverwritePolicy(conn.ctx, dir)
+	}
+	return OverwriteAllow, nil
+}
+
+// reserveUploadPath claims `filePath` for an upload if no other upload has claimed it
+func reserveUploadPath(filePath string) bool {
+	globalLock.Lock()
+	defer globalLock.Unlock()
+	if reservedUploadPaths[filePath] {
+		return false
+	}
+	reservedUploadPaths[filePath] = true
+	return true
+}
+
+// releaseUploadPath ends the claim of an upload on `filePath`
+func releaseUploadPath(filePath string) {
+	globalLock.Lock()
+	delete(reservedUploadPaths, filePath)
+	globalLock.Unlock()
+}
+
+// fileExists reports whether `filePath` is taken, counting unreadable paths as taken
+func (conn *ftpConnection) fileExists(filePath string) bool {
+	_, err := conn.storage().Stat(filePath)
+	return !os.IsNotExist(err)
+}
+
+// reserveUniquePath claims the first unused name among `filePath`, then `name.1.ext`,
+// `name.2.ext`, ... in the same directory. The claim is released with releaseUploadPath.
+func (conn *ftpConnection) reserveUniquePath(filePath string) (string, error) {
+	dir, name := path.Split(filePath)
+	ext := path.Ext(name)
+	stem := strings.TrimSuffix(name, ext)
+	if stem == "" {
+		// Hidden files such as ".profile" have no extension
+		stem, ext = name, ""
+	}
+	for i := 0; i < maxUniqueNameAttempts; i++ {
+		candidate := filePath
+		if i > 0 {
+			candidate = path.Join(dir, stem+"."+strconv.Itoa(i)+ext)
+		}
+		if conn.fileExists(candidate) || !reserveUploadPath(candidate) {
+			continue
+		}
+		// The file may have been created since it was checked
+		if conn.fileExists(candidate) {
+			releaseUploadPath(candidate)
+			continue
+		}
+		return candidate, nil
+	}
+	return "", errors.New("No unique file name available for " + filePath)
+}
+
+// uploadTarget is the file an upload is stored to
+type uploadTarget struct {
+	path    string
+	claimed bool // Whether the path is claimed until released with releaseUploadPath
+	unique  bool // Whether the path is a unique name to report to the user
+}
+
+// uploadTarget applies the overwrite policy of its directory to an upload to `filePath`,
+// or picks an unused name derived from it for STOU (`unique`)
+func (conn *ftpConnection) uploadTarget(filePath string, unique bool, offset int64) (uploadTarget, error) {
+	if !unique {
+		policy, err := conn.overwritePolicy(path.Dir(filePath))
+		if err != nil {
+			return uploadTarget{}, err
+		}
+		switch policy {
+		case OverwriteAllow:
+			return uploadTarget{path: filePath}, nil
+		case OverwriteRefuse:
+			if !reserveUploadPath(filePath) {
+				return uploadTarget{}, errFileExists
+			}
+			if conn.fileExists(filePath) {
+				releaseUploadPath(filePath)
+				return uploadTarget{}, errFileExists
+			}
+			return uploadTarget{path: filePath, claimed: true}, nil
+		case OverwriteRename:
+			// Resuming an upload is only possible under its existing name
+			if offset > 0 && conn.fileExists(filePath) {
+				return uploadTarget{}, errFileExists
+			}
+		}
+	}
+	uniquePath, err := conn.reserveUniquePath(filePath)
+	if err != nil {
+		return uploadTarget{}, err
+	}
+	return uploadTarget{path: uniquePath, claimed: true, unique: true}, nil
+}
+
+// stouBaseName returns the name from which STOU derives a unique name when none is given
+func stouBaseName() string {
+	return "stou-" + time.Now().UTC().Format(ftpTimeFormat)
+}
@@ -0,0 +1,378 @@
+package s3fs
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// client performs the S3 API requests used by Storage, signed with AWS Signature Version 4
+type client struct {
+	endpoint  *url.URL
+	region    string
+	bucket    string
+	accessKey string
+	secretKey string
+	pathStyle bool
+	http      *http.Client
+}
+
+// objectInfo describes an object or, in listings, a common prefix
+type objectInfo struct {
+	Key          string    `xml:"Key"`
+	Size         int64     `xml:"Size"`
+	LastModified time.Time `xml:"LastModified"`
+}
+
+// listResult is the reply to ListObjectsV2
+type listResult struct {
+	Contents       []objectInfo `xml:"Contents"`
+	CommonPrefixes []struct {
+		Prefix string `xml:"Prefix"`
+	} `xml:"CommonPrefixes"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// completedPart identifies an uploaded part when completing a multipart upload
+type completedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+// responseError is an error reply of the S3 API
+type responseError struct {
+	StatusCode int
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+}
+
+func (e *responseError) Error() string {
+	return fmt.Sprintf("s3: %d %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+// pathError converts S3 errors about missing or forbidden objects to the os errors the
+// server recognizes
+func pathError(op string, name string, err error) error {
+	if err == nil {
+		return nil
+	}
+	var s3Err *responseError
+	if errors.As(err, &s3Err) {
+		switch s3Err.StatusCode {
+		case http.StatusNotFound:
+			err = os.ErrNotExist
+		case http.StatusForbidden:
+			err = os.ErrPermission
+		}
+	}
+	return &os.PathError{Op: op, Path: name, Err: err}
+}
+
+// objectURL returns the URL of an object, or of the bucket if `key` is empty
+func (c *client) objectURL(key string, query url.Values) *url.URL {
+	u := *c.endpoint
+	if c.pathStyle {
+		u.Path = "/" + c.bucket + "/" + key
+	} else {
+		u.Host = c.bucket + "." + u.Host
+		u.Path = "/" + key
+	}
+	u.RawPath = encodePath(u.Path)
+	u.RawQuery = canonicalQuery(query)
+	return &u
+}
+
+// do sends a signed request and returns the response if its status is `expected`
+func (c *client) do(method string, key string, query url.Values, header http.Header, body []byte, expected ...int) (*http.Response, error) {
+	u := c.objectURL(key, query)
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.ContentLength = int64(len(body))
+	c.sign(req, u, body, time.Now().UTC())
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	for _, status := range expected {
+		if resp.StatusCode == status {
+			return resp, nil
+		}
+	}
+	defer resp.Body.Close()
+	s3Err := &responseError{StatusCode: resp.StatusCode, Code: http.StatusText(resp.StatusCode)}
+	if data, err := ioutil.ReadAll(resp.Body); err == nil && len(data) > 0 {
+		xml.Unmarshal(data, s3Err)
+	}
+	return nil, s3Err
+}
+
+// sign adds the AWS Signature Version 4 headers to a request
+func (c *client) sign(req *http.Request, u *url.URL, body []byte, now time.Time) {
+	payloadHash := sha256.Sum256(body)
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+
+	signedNames := []string{"host"}
+	for name := range req.Header {
+		if lower := strings.ToLower(name); strings.HasPrefix(lower, "x-amz-") {
+			signedNames = append(signedNames, lower)
+		}
+	}
+	sort.Strings(signedNames)
+	var canonicalHeaders strings.Builder
+	for _, name := range signedNames {
+		value := req.Host
+		if value == "" {
+			value = u.Host
+		}
+		if name != "host" {
+			value = strings.TrimSpace(req.Header.Get(name))
+		}
+		canonicalHeaders.WriteString(name + ":" + value + "\n")
+	}
+	signedHeaders := strings.Join(signedNames, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		u.EscapedPath(),
+		u.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+	scope := date + "/" + c.region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+c.secretKey), date)
+	key = hmacSHA256(key, c.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+c.accessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// encodePath escapes every segment of a path as required by Signature Version 4
+func encodePath(p string) string {
+	segments := strings.Split(p, "/")
+	for i, segment := range segments {
+		segments[i] = uriEncode(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+// canonicalQuery encodes query parameters sorted by name, as required by Signature Version 4
+func canonicalQuery(query url.Values) string {
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	pairs := make([]string, 0, len(names))
+	for _, name := range names {
+		for _, value := range query[name] {
+			pairs = append(pairs, uriEncode(name)+"="+uriEncode(value))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// uriEncode percent-encodes all but the unreserved characters of RFC 3986
+func uriEncode(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// headObject returns the size and modification time of an object
+func (c *client) headObject(key string) (objectInfo, error) {
+	resp, err := c.do(http.MethodHead, key, nil, nil, nil, http.StatusOK)
+	if err != nil {
+		return objectInfo{}, err
+	}
+	resp.Body.Close()
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return objectInfo{Key: key, Size: resp.ContentLength, LastModified: modTime}, nil
+}
+
+// getObject returns the contents of an object from `offset` with a ranged GET
+func (c *client) getObject(key string, offset int64) (io.ReadCloser, error) {
+	header := http.Header{}
+	if offset > 0 {
+		header.Set("Range", "bytes="+strconv.FormatInt(offset, 10)+"-")
+	}
+	resp, err := c.do(http.MethodGet, key, nil, header, nil, http.StatusOK, http.StatusPartialContent, http.StatusRequestedRangeNotSatisfiable)
+	if err != nil {
+		return nil, err
+	}
+	// Reading from the end of an object yields nothing
+	if resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+		resp.Body.Close()
+		return ioutil.NopCloser(bytes.NewReader(nil)), nil
+	}
+	return resp.Body, nil
+}
+
+// putObject stores an object in a single request
+func (c *client) putObject(key string, data []byte) error {
+	resp, err := c.do(http.MethodPut, key, nil, nil, data, http.StatusOK)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// copyObject copies an object within the bucket
+func (c *client) copyObject(srcKey string, dstKey string) error {
+	header := http.Header{}
+	header.Set("X-Amz-Copy-Source", encodePath("/"+c.bucket+"/"+srcKey))
+	resp, err := c.do(http.MethodPut, dstKey, nil, header, nil, http.StatusOK)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// A copy may fail after the reply has started, with an error in a 200 reply
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if bytes.Contains(data, []byte("<Error>")) {
+		s3Err := &responseError{StatusCode: http.StatusInternalServerError}
+		xml.Unmarshal(data, s3Err)
+		return s3Err
+	}
+	return nil
+}
+
+// deleteObject deletes an object, succeeding if it does not exist
+func (c *client) deleteObject(key string) error {
+	resp, err := c.do(http.MethodDelete, key, nil, nil, nil, http.StatusNoContent, http.StatusOK)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// listObjects returns a page of the objects whose key starts with `prefix`. With a
+// delimiter, keys containing it past the prefix are grouped as common prefixes.
+func (c *client) listObjects(prefix string, delimiter string, token string, maxKeys int) (*listResult, error) {
+	query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+	if delimiter != "" {
+		query.Set("delimiter", delimiter)
+	}
+	if token != "" {
+		query.Set("continuation-token", token)
+	}
+	if maxKeys > 0 {
+		query.Set("max-keys", strconv.Itoa(maxKeys))
+	}
+	resp, err := c.do(http.MethodGet, "", query, nil, nil, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	result := &listResult{}
+	if err := xml.NewDecoder(resp.Body).Decode(result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// createMultipartUpload starts a multipart upload and returns its ID
+func (c *client) createMultipartUpload(key string) (string, error) {
+	resp, err := c.do(http.MethodPost, key, url.Values{"uploads": {""}}, nil, nil, http.StatusOK)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var result struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", err
+	}
+	return result.UploadID, nil
+}
+
+// uploadPart uploads a part of a multipart upload and returns its ETag
+func (c *client) uploadPart(key string, uploadID string, partNumber int, data []byte) (string, error) {
+	query := url.Values{"partNumber": {strconv.Itoa(partNumber)}, "uploadId": {uploadID}}
+	resp, err := c.do(http.MethodPut, key, query, nil, data, http.StatusOK)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	return resp.Header.Get("ETag"), nil
+}
+
+// completeMultipartUpload assembles the uploaded parts into the object
+func (c *client) completeMultipartUpload(key string, uploadID string, parts []completedPart) error {
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+		Parts   []completedPart `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(http.MethodPost, key, url.Values{"uploadId": {uploadID}}, nil, body, http.StatusOK)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// Like copies, completions may fail after the reply has started
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if bytes.Contains(data, []byte("<Error>")) {
+		s3Err := &responseError{StatusCode: http.StatusInternalServerError}
+		xml.Unmarshal(data, s3Err)
+		return s3Err
+	}
+	return nil
+}
+
+// abortMultipartUpload discards the parts of an unfinished multipart upload
+func (c *client) abortMultipartUpload(key string, uploadID string) error {
+	resp, err := c.do(http.MethodDelete, key, url.Values{"uploadId": {uploadID}}, nil, nil, http.StatusNoContent, http.StatusOK)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
@@ -0,0 +1,410 @@
+// Package s3fs serves the objects of an S3 compatible bucket as the storage of the FTP server.
+// Paths map to object keys, directories are synthesized from key prefixes, uploads are
+// streamed as multipart uploads, resumed downloads use ranged GETs and renames are done
+// by copying then deleting objects.
+package s3fs
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultPartSize is the size of the parts of multipart uploads unless configured
+	DefaultPartSize = 8 * 1024 * 1024
+	// MinPartSize is the smallest part size allowed by S3, except for the last part
+	MinPartSize = 5 * 1024 * 1024
+)
+
+// Config locates a bucket and the credentials to access it
+type Config struct {
+	// Endpoint of the S3 API, e.g. "https://s3.eu-west-1.amazonaws.com" or the address
+	// of a local S3 compatible server such as "http://127.0.0.1:9000"
+	Endpoint string
+	// Region of the bucket, "us-east-1" if empty
+	Region string
+	Bucket string
+	// Credentials signing the requests
+	AccessKey string
+	SecretKey string
+	// Addresses the bucket in the request path rather than the host name, as required by
+	// most S3 compatible servers
+	PathStyle bool
+	// Key prefix under which the FTP tree is stored, e.g. "ftp/"
+	Prefix string
+	// Bytes buffered before each part of an upload is sent, DefaultPartSize if zero
+	PartSize int64
+	// Client sending the requests, http.DefaultClient if nil
+	HTTPClient *http.Client
+}
+
+// Storage is a Storage of the FTP server backed by an S3 bucket. Directories are the
+// prefixes of object keys, marked by empty objects whose key ends with "/" when created
+// with Mkdir. Files are only visible once their upload is complete.
+type Storage struct {
+	client   *client
+	prefix   string
+	partSize int64
+}
+
+// New creates a Storage of the bucket described by `config`
+func New(config Config) (*Storage, error) {
+	endpoint, err := url.Parse(config.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if endpoint.Scheme == "" || endpoint.Host == "" {
+		return nil, errors.New("s3: endpoint must be an absolute URL")
+	}
+	if config.Bucket == "" {
+		return nil, errors.New("s3: bucket required")
+	}
+	region := config.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+	httpClient := config.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	partSize := config.PartSize
+	if partSize == 0 {
+		partSize = DefaultPartSize
+	} else if partSize < MinPartSize {
+		return nil, errors.New("s3: part size below the 5 MiB minimum")
+	}
+	prefix := strings.Trim(config.Prefix, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	return &Storage{
+		client: &client{
+			endpoint:  endpoint,
+			region:    region,
+			bucket:    config.Bucket,
+			accessKey: config.AccessKey,
+			secretKey: config.SecretKey,
+			pathStyle: config.PathStyle,
+			http:      httpClient,
+		},
+		prefix:   prefix,
+		partSize: partSize,
+	}, nil
+}
+
+// objectKey returns the key of the object stored at an FTP path
+func (s *Storage) objectKey(name string) string {
+	return s.prefix + strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+// dirPrefix returns the key prefix of the objects in a directory
+func (s *Storage) dirPrefix(name string) string {
+	key := s.objectKey(name)
+	if key == "" || strings.HasSuffix(key, "/") {
+		return key
+	}
+	return key + "/"
+}
+
+// Stat returns information about an object, or about a directory if objects exist
+// under its prefix
+func (s *Storage) Stat(name string) (os.FileInfo, error) {
+	base := path.Base(path.Clean("/" + name))
+	if s.objectKey(name) != s.prefix {
+		object, err := s.client.headObject(s.objectKey(name))
+		if err == nil {
+			return &fileInfo{name: base, size: object.Size, modTime: object.LastModified}, nil
+		}
+		if !os.IsNotExist(pathError("stat", name, err)) {
+			return nil, pathError("stat", name, err)
+		}
+	}
+	// The root always exists, other directories once an object is stored under them
+	if path.Clean("/"+name) != "/" {
+		result, err := s.client.listObjects(s.dirPrefix(name), "", "", 1)
+		if err != nil {
+			return nil, pathError("stat", name, err)
+		}
+		if len(result.Contents) == 0 {
+			return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+		}
+	}
+	return &fileInfo{name: base, dir: true}, nil
+}
+
+// ReadDir lists the objects and synthesized directories directly under a directory
+func (s *Storage) ReadDir(name string) ([]os.FileInfo, error) {
+	prefix := s.dirPrefix(name)
+	infos := []os.FileInfo{}
+	found := false
+	token := ""
+	for {
+		result, err := s.client.listObjects(prefix, "/", token, 0)
+		if err != nil {
+			return nil, pathError("readdir", name, err)
+		}
+		for _, object := range result.Contents {
+			found = true
+			// The marker of the directory itself
+			if object.Key == prefix {
+				continue
+			}
+			infos = append(infos, &fileInfo{
+				name:    strings.TrimPrefix(object.Key, prefix),
+				size:    object.Size,
+				modTime: object.LastModified,
+			})
+		}
+		for _, common := range result.CommonPrefixes {
+			found = true
+			infos = append(infos, &fileInfo{
+				name: strings.TrimSuffix(strings.TrimPrefix(common.Prefix, prefix), "/"),
+				dir:  true,
+			})
+		}
+		if !result.IsTruncated {
+			break
+		}
+		token = result.NextContinuationToken
+	}
+	if !found && path.Clean("/"+name) != "/" {
+		return nil, &os.PathError{Op: "readdir", Path: name, Err: os.ErrNotExist}
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+	return infos, nil
+}
+
+// Open reads an object from `offset` with a ranged GET
+func (s *Storage) Open(name string, offset int64) (io.ReadCloser, error) {
+	body, err := s.client.getObject(s.objectKey(name), offset)
+	if err != nil {
+		return nil, pathError("open", name, err)
+	}
+	return body, nil
+}
+
+// Create streams an object to the bucket as it is written, in parts of the configured
+// size. The object replaces any existing one once the writer is closed. Writing from an
+// offset first copies the start of the existing object into the new one.
+func (s *Storage) Create(name string, offset int64) (io.WriteCloser, error) {
+	w := &writer{client: s.client, key: s.objectKey(name), name: name, partSize: s.partSize}
+	if offset > 0 {
+		existing, err := s.client.getObject(w.key, 0)
+		if err != nil {
+			return nil, pathError("create", name, err)
+		}
+		defer existing.Close()
+		if _, err := io.CopyN(w, existing, offset); err != nil {
+			w.abort()
+			if err == io.EOF {
+				err = errors.New("offset beyond the end of the object")
+			}
+			return nil, pathError("create", name, err)
+		}
+	}
+	return w, nil
+}
+
+// Remove deletes an object, or the marker of an empty directory
+func (s *Storage) Remove(name string) error {
+	info, err := s.Stat(name)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return pathError("remove", name, s.client.deleteObject(s.objectKey(name)))
+	}
+	prefix := s.dirPrefix(name)
+	result, err := s.client.listObjects(prefix, "", "", 2)
+	if err != nil {
+		return pathError("remove", name, err)
+	}
+	for _, object := range result.Contents {
+		if object.Key != prefix {
+			return &os.PathError{Op: "remove", Path: name, Err: errors.New("directory not empty")}
+		}
+	}
+	return pathError("remove", name, s.client.deleteObject(prefix))
+}
+
+// Rename copies an object, or every object of a directory, to the new path then deletes
+// the originals. Renaming is not atomic: a failure may leave objects under both paths.
+func (s *Storage) Rename(from string, to string) error {
+	info, err := s.Stat(from)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		if err := s.client.copyObject(s.objectKey(from), s.objectKey(to)); err != nil {
+			return &os.LinkError{Op: "rename", Old: from, New: to, Err: err}
+		}
+		return pathError("rename", from, s.client.deleteObject(s.objectKey(from)))
+	}
+	fromPrefix, toPrefix := s.dirPrefix(from), s.dirPrefix(to)
+	if strings.HasPrefix(toPrefix, fromPrefix) {
+		return &os.LinkError{Op: "rename", Old: from, New: to, Err: os.ErrInvalid}
+	}
+	token := ""
+	for {
+		result, err := s.client.listObjects(fromPrefix, "", token, 0)
+		if err != nil {
+			return &os.LinkError{Op: "rename", Old: from, New: to, Err: err}
+		}
+		for _, object := range result.Contents {
+			toKey := toPrefix + strings.TrimPrefix(object.Key, fromPrefix)
+			if err := s.client.copyObject(object.Key, toKey); err != nil {
+				return &os.LinkError{Op: "rename", Old: from, New: to, Err: err}
+			}
+			if err := s.client.deleteObject(object.Key); err != nil {
+				return &os.LinkError{Op: "rename", Old: from, New: to, Err: err}
+			}
+		}
+		if !result.IsTruncated {
+			return nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// Mkdir stores the marker object of a directory
+func (s *Storage) Mkdir(name string) error {
+	if _, err := s.Stat(name); err == nil {
+		return &os.PathError{Op: "mkdir", Path: name, Err: os.ErrExist}
+	}
+	return pathError("mkdir", name, s.client.putObject(s.dirPrefix(name), nil))
+}
+
+// Chtimes is not supported, S3 sets the modification time of objects when they are stored
+func (s *Storage) Chtimes(name string, modTime time.Time) error {
+	return &os.PathError{Op: "chtimes", Path: name, Err: errors.New("modification times of objects cannot be set")}
+}
+
+// writer buffers the contents of an object, sending every full buffer as a part of a
+// multipart upload. Objects smaller than a part are stored with a single request.
+type writer struct {
+	client   *client
+	key      string
+	name     string
+	partSize int64
+	buffer   []byte
+	uploadID string
+	parts    []completedPart
+	err      error
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	written := 0
+	for len(p) > 0 {
+		n := int(w.partSize) - len(w.buffer)
+		if n > len(p) {
+			n = len(p)
+		}
+		w.buffer = append(w.buffer, p[:n]...)
+		written += n
+		p = p[n:]
+		if int64(len(w.buffer)) == w.partSize {
+			if err := w.flush(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// flush sends the buffer as the next part of the upload
+func (w *writer) flush() error {
+	if w.uploadID == "" {
+		uploadID, err := w.client.createMultipartUpload(w.key)
+		if err != nil {
+			w.err = pathError("write", w.name, err)
+			return w.err
+		}
+		w.uploadID = uploadID
+	}
+	partNumber := len(w.parts) + 1
+	etag, err := w.client.uploadPart(w.key, w.uploadID, partNumber, w.buffer)
+	if err != nil {
+		w.abort()
+		w.err = pathError("write", w.name, err)
+		return w.err
+	}
+	w.parts = append(w.parts, completedPart{PartNumber: partNumber, ETag: etag})
+	w.buffer = w.buffer[:0]
+	return nil
+}
+
+// Close stores the object, completing the multipart upload if parts were sent
+func (w *writer) Close() error {
+	if w.err != nil {
+		return w.err
+	}
+	defer func() {
+		if w.err == nil {
+			w.err = &os.PathError{Op: "close", Path: w.name, Err: os.ErrClosed}
+		}
+	}()
+	if w.uploadID == "" {
+		if err := w.client.putObject(w.key, w.buffer); err != nil {
+			return pathError("close", w.name, err)
+		}
+		return nil
+	}
+	if len(w.buffer) > 0 {
+		if err := w.flush(); err != nil {
+			return err
+		}
+	}
+	if err := w.client.completeMultipartUpload(w.key, w.uploadID, w.parts); err != nil {
+		w.abort()
+		return pathError("close", w.name, err)
+	}
+	return nil
+}
+
+// Abort discards the object being written, leaving any object stored under its key untouched
+func (w *writer) Abort() error {
+	w.abort()
+	w.buffer = nil
+	if w.err == nil {
+		w.err = &os.PathError{Op: "close", Path: w.name, Err: os.ErrClosed}
+	}
+	return nil
+}
+
+// abort discards the parts already sent
+func (w *writer) abort() {
+	if w.uploadID != "" {
+		w.client.abortMultipartUpload(w.key, w.uploadID)
+		w.uploadID = ""
+	}
+}
+
+// fileInfo describes an object or a synthesized directory
+type fileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func (fi *fileInfo) Name() string { return fi.name }
+func (fi *fileInfo) Size() int64  { return fi.size }
+func (fi *fileInfo) Mode() os.FileMode {
+	if fi.dir {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
+func (fi *fileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *fileInfo) IsDir() bool        { return fi.dir }
+func (fi *fileInfo) Sys() interface{}   { return nil }
@@ -0,0 +1,352 @@
+// In-process S3 server stub for exercising s3fs.Storage without a bucket
+package s3test
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Server is an in-memory S3 API addressed in path style, e.g.
+// `s3fs.Config{Endpoint: server.URL(), PathStyle: true, ...}`. Requests must be signed, but
+// only the payload hash covered by the signature is checked, not the signature itself.
+type Server struct {
+	lock     sync.Mutex
+	http     *httptest.Server
+	buckets  map[string]map[string]*object
+	uploads  map[string]*upload
+	uploadID int
+	requests map[string]int // Requests received by method
+}
+
+type object struct {
+	data    []byte
+	modTime time.Time
+}
+
+type upload struct {
+	bucket string
+	key    string
+	parts  map[int][]byte
+}
+
+// NewServer starts a server without buckets
+func NewServer() *Server {
+	s := &Server{
+		buckets:  make(map[string]map[string]*object),
+		uploads:  make(map[string]*upload),
+		requests: make(map[string]int),
+	}
+	s.http = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+// URL returns the endpoint of the server
+func (s *Server) URL() string {
+	return s.http.URL
+}
+
+// Close stops the server
+func (s *Server) Close() {
+	s.http.Close()
+}
+
+// CreateBucket adds an empty bucket
+func (s *Server) CreateBucket(bucket string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.buckets[bucket] == nil {
+		s.buckets[bucket] = make(map[string]*object)
+	}
+}
+
+// Object returns the contents of an object
+func (s *Server) Object(bucket string, key string) ([]byte, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	o, ok := s.buckets[bucket][key]
+	if !ok {
+		return nil, false
+	}
+	return o.data, true
+}
+
+// Keys returns the keys of the objects of a bucket, sorted
+func (s *Server) Keys(bucket string) []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	keys := []string{}
+	for key := range s.buckets[bucket] {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Requests returns the number of requests received with a method, to observe multipart
+// uploads and ranged reads
+func (s *Server) Requests(method string) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.requests[method]
+}
+
+// Uploads returns the number of multipart uploads neither completed nor aborted
+func (s *Server) Uploads() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.uploads)
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.requests[r.Method]++
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 ") {
+		sendError(w, http.StatusForbidden, "AccessDenied")
+		return
+	}
+	elements := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	bucket, ok := s.buckets[elements[0]]
+	if !ok {
+		sendError(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	key := ""
+	if len(elements) == 2 {
+		key = elements[1]
+	}
+	query := r.URL.Query()
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		sendError(w, http.StatusBadRequest, "IncompleteBody")
+		return
+	}
+	if sum := sha256.Sum256(body); r.Header.Get("X-Amz-Content-Sha256") != hex.EncodeToString(sum[:]) {
+		sendError(w, http.StatusBadRequest, "XAmzContentSHA256Mismatch")
+		return
+	}
+	switch {
+	case key == "" && r.Method == http.MethodGet:
+		s.list(w, bucket, query)
+	case key == "":
+		sendError(w, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	case r.Method == http.MethodPost && query["uploads"] != nil:
+		s.uploadID++
+		id := strconv.Itoa(s.uploadID)
+		s.uploads[id] = &upload{bucket: elements[0], key: key, parts: make(map[int][]byte)}
+		sendXML(w, struct {
+			XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+			UploadID string   `xml:"UploadId"`
+		}{UploadID: id})
+	case query.Get("uploadId") != "":
+		s.multipart(w, r, bucket, key, query, body)
+	case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") != "":
+		source := strings.SplitN(strings.TrimPrefix(r.Header.Get("X-Amz-Copy-Source"), "/"), "/", 2)
+		if len(source) != 2 || source[0] != elements[0] {
+			sendError(w, http.StatusBadRequest, "InvalidArgument")
+			return
+		}
+		sourceKey, err := url.PathUnescape(source[1])
+		o, ok := bucket[sourceKey]
+		if err != nil || !ok {
+			sendError(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		bucket[key] = &object{data: o.data, modTime: time.Now()}
+		sendXML(w, struct {
+			XMLName xml.Name `xml:"CopyObjectResult"`
+		}{})
+	case r.Method == http.MethodPut:
+		bucket[key] = &object{data: body, modTime: time.Now()}
+		w.Header().Set("ETag", etag(body))
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		o, ok := bucket[key]
+		if !ok {
+			sendError(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		w.Header().Set("Last-Modified", o.modTime.UTC().Format(http.TimeFormat))
+		w.Header().Set("ETag", etag(o.data))
+		// Only open ended ranges, as sent by s3fs, are supported
+		data := o.data
+		status := http.StatusOK
+		if spec := r.Header.Get("Range"); spec != "" {
+			offset, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(spec, "bytes="), "-"))
+			if err != nil || offset >= len(data) {
+				sendError(w, http.StatusRequestedRangeNotSatisfiable, "InvalidRange")
+				return
+			}
+			data = data[offset:]
+			status = http.StatusPartialContent
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.WriteHeader(status)
+		if r.Method == http.MethodGet {
+			w.Write(data)
+		}
+	case r.Method == http.MethodDelete:
+		delete(bucket, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		sendError(w, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	}
+}
+
+// list answers ListObjectsV2 requests. Continuation tokens are the last key returned.
+func (s *Server) list(w http.ResponseWriter, bucket map[string]*object, query map[string][]string) {
+	get := func(name string) string {
+		if values := query[name]; len(values) > 0 {
+			return values[0]
+		}
+		return ""
+	}
+	prefix, delimiter, token := get("prefix"), get("delimiter"), get("continuation-token")
+	maxKeys := 1000
+	if n, err := strconv.Atoi(get("max-keys")); err == nil && n > 0 && n < maxKeys {
+		maxKeys = n
+	}
+	keys := []string{}
+	for key := range bucket {
+		if strings.HasPrefix(key, prefix) && key > token {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	type content struct {
+		Key          string `xml:"Key"`
+		Size         int    `xml:"Size"`
+		LastModified string `xml:"LastModified"`
+	}
+	type commonPrefix struct {
+		Prefix string `xml:"Prefix"`
+	}
+	result := struct {
+		XMLName               xml.Name       `xml:"ListBucketResult"`
+		Prefix                string         `xml:"Prefix"`
+		KeyCount              int            `xml:"KeyCount"`
+		IsTruncated           bool           `xml:"IsTruncated"`
+		NextContinuationToken string         `xml:"NextContinuationToken,omitempty"`
+		Contents              []content      `xml:"Contents"`
+		CommonPrefixes        []commonPrefix `xml:"CommonPrefixes"`
+	}{Prefix: prefix}
+	last := ""
+	for _, key := range keys {
+		if result.KeyCount == maxKeys {
+			result.IsTruncated = true
+			result.NextContinuationToken = last
+			break
+		}
+		if delimiter != "" {
+			if i := strings.Index(key[len(prefix):], delimiter); i >= 0 {
+				common := key[:len(prefix)+i+len(delimiter)]
+				// Skip the remaining keys of the common prefix
+				if last != "" && strings.HasPrefix(last, common) {
+					last = key
+					continue
+				}
+				result.CommonPrefixes = append(result.CommonPrefixes, commonPrefix{Prefix: common})
+				result.KeyCount++
+				last = key
+				continue
+			}
+		}
+		o := bucket[key]
+		result.Contents = append(result.Contents, content{
+			Key:          key,
+			Size:         len(o.data),
+			LastModified: o.modTime.UTC().Format(time.RFC3339Nano),
+		})
+		result.KeyCount++
+		last = key
+	}
+	sendXML(w, result)
+}
+
+// multipart answers the requests uploading, completing or aborting parts of an upload
+func (s *Server) multipart(w http.ResponseWriter, r *http.Request, bucket map[string]*object, key string, query map[string][]string, body []byte) {
+	id := query["uploadId"][0]
+	u, ok := s.uploads[id]
+	if !ok || u.key != key {
+		sendError(w, http.StatusNotFound, "NoSuchUpload")
+		return
+	}
+	switch r.Method {
+	case http.MethodPut:
+		partNumber, err := strconv.Atoi(r.URL.Query().Get("partNumber"))
+		if err != nil || partNumber < 1 {
+			sendError(w, http.StatusBadRequest, "InvalidArgument")
+			return
+		}
+		u.parts[partNumber] = body
+		w.Header().Set("ETag", etag(body))
+	case http.MethodPost:
+		var complete struct {
+			Parts []struct {
+				PartNumber int    `xml:"PartNumber"`
+				ETag       string `xml:"ETag"`
+			} `xml:"Part"`
+		}
+		if err := xml.Unmarshal(body, &complete); err != nil || len(complete.Parts) == 0 {
+			sendError(w, http.StatusBadRequest, "MalformedXML")
+			return
+		}
+		data := []byte{}
+		for i, part := range complete.Parts {
+			partData, ok := u.parts[part.PartNumber]
+			if !ok || part.ETag != etag(partData) {
+				sendError(w, http.StatusBadRequest, "InvalidPart")
+				return
+			}
+			if i < len(complete.Parts)-1 && len(partData) < 5*1024*1024 {
+				sendError(w, http.StatusBadRequest, "EntityTooSmall")
+				return
+			}
+			data = append(data, partData...)
+		}
+		bucket[key] = &object{data: data, modTime: time.Now()}
+		delete(s.uploads, id)
+		sendXML(w, struct {
+			XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+			Key     string   `xml:"Key"`
+		}{Key: key})
+	case http.MethodDelete:
+		delete(s.uploads, id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		sendError(w, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	}
+}
+
+func etag(data []byte) string {
+	sum := md5.Sum(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+func sendXML(w http.ResponseWriter, v interface{}) {
+	data, err := xml.Marshal(v)
+	if err != nil {
+		sendError(w, http.StatusInternalServerError, "InternalError")
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.Write([]byte(xml.Header))
+	w.Write(data)
+}
+
+func sendError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	w.Write([]byte(xml.Header + "<Error><Code>" + code + "</Code><Message>" + http.StatusText(status) + "</Message></Error>"))
+}
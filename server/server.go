@@ -3,12 +3,15 @@ package server
 
 import (
 	"bufio"
+	"compress/zlib"
+	"context"
 	"crypto/tls"
 	"fmt"
 	"log"
 	"net"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/Charana123/ftp/utils"
 	"github.com/ziutek/telnet"
@@ -21,6 +24,10 @@ var (
 	globalServerSettings *ServerSettings
 	// accessControlSettings is a set of user defined access control rules
 	globalAccessControlSettings map[string][]string
+	// tlsConfig secures control connections and, after PROT P, data connections
+	globalTLSConfig *tls.Config
+	// storage holds the files served, the local filesystem unless the settings name another
+	globalStorage Storage
 )
 
 type ftpConnection struct {
@@ -32,8 +39,29 @@ type ftpConnection struct {
 	closing             bool
 	isPasv              bool
 	pasvDataListener    net.Listener
+	pasvData            chan net.Conn
 	pasvPort            int
 	activeAddr          net.Addr
+	loginUser           string
+	failedLogins        int
+	tlsConn             *tls.Conn
+	certUser            string
+	zlibLevel           int
+	restartOffset       int64
+	dataReusable        bool
+	hashRange           *byteRange
+	cancelTransfer      context.CancelFunc
+	expectedHash        string
+	userStorage         Storage
+}
+
+// remoteIP returns the IP address of the user end of the control connection
+func (conn *ftpConnection) remoteIP() string {
+	host, _, err := net.SplitHostPort(conn.control.RemoteAddr().String())
+	if err != nil {
+		return conn.control.RemoteAddr().String()
+	}
+	return host
 }
 
 // sendReply is a convnience method to corrently format and sends an FTP reply code
@@ -44,8 +72,36 @@ func (conn *ftpConnection) sendReply(replyCode int, description string) {
 	fmt.Fprintf(conn.control, message)
 }
 
+// preLoginCommands are the commands served before the user has logged in
+var preLoginCommands = map[string]bool{
+	"USER": true,
+	"PASS": true,
+	"SYST": true,
+	"FEAT": true,
+	"CLNT": true,
+	"OPTS": true,
+	"PBSZ": true,
+	"PROT": true,
+	"NOOP": true,
+	"QUIT": true,
+}
+
+// sendMultilineReply sends a multi-line FTP reply whose intermediate lines are indented
+// by a space, e.g. the reply to FEAT
+func (conn *ftpConnection) sendMultilineReply(replyCode int, first string, lines []string, last string) {
+	message := strconv.Itoa(replyCode) + "-" + first + "\r\n"
+	for _, line := range lines {
+		message += " " + line + "\r\n"
+	}
+	message += strconv.Itoa(replyCode) + " " + last + "\r\n"
+	log.Print("server to (" + conn.control.RemoteAddr().String() + "): " + message)
+	fmt.Fprint(conn.control, message)
+}
+
 func (conn *ftpConnection) handleCommand(command string, arguments []string) bool {
-	if command != "USER" || command != "PASS" || conn.loggedIn {
+	if !conn.loggedIn && !preLoginCommands[command] {
+		conn.sendReply(530, "Not logged in.")
+	} else {
 		if conn.closing {
 			conn.sendReply(421, "Service not available, closing control connection.")
 		} else {
@@ -57,14 +113,22 @@ func (conn *ftpConnection) handleCommand(command string, arguments []string) boo
 				conn.pass(arguments)
 			// Handle Connection
 			case "PORT":
-				conn.port(arguments[0])
+				conn.port(arguments)
+			case "EPRT":
+				conn.eprt(arguments)
 			case "PASV":
 				conn.pasv()
 			// Handle Directory
 			case "CWD":
 				conn.cwd(arguments)
 			case "LIST":
-				conn.list()
+				conn.list(arguments)
+			case "NLST":
+				conn.nlst(arguments)
+			case "MLSD":
+				conn.mlsd(arguments)
+			case "MLST":
+				conn.mlst(arguments)
 			case "PWD":
 				conn.sendReply(257, conn.ctx.CWD)
 			// Handle File
@@ -72,22 +136,63 @@ func (conn *ftpConnection) handleCommand(command string, arguments []string) boo
 				conn.size(arguments)
 			case "MDTM":
 				conn.mdtm(arguments)
+			case "MFMT":
+				conn.mfmt(arguments)
+			case "MFCT":
+				conn.mfct(arguments)
 			case "RETR":
 				conn.retr(arguments)
 			case "STOR":
 				conn.stor(arguments)
+			case "STOU":
+				conn.stou(arguments)
+			case "DELE":
+				conn.dele(arguments)
+			case "REST":
+				conn.rest(arguments)
+			case "ABOR":
+				conn.abor()
+			// Handle Hash
+			case "HASH":
+				conn.hash(arguments)
+			case "RANG":
+				conn.rang(arguments)
+			case "XMD5":
+				conn.legacyHash("MD5", arguments)
+			case "XSHA1":
+				conn.legacyHash("SHA-1", arguments)
+			case "XSHA256":
+				conn.legacyHash("SHA-256", arguments)
+			case "XCRC":
+				conn.legacyHash("CRC32", arguments)
 			// Handle Micellenous
 			case "TYPE":
-				conn.ttype(arguments[0])
+				conn.ttype(arguments)
 			case "STRU":
 				conn.stru(arguments[0])
 			case "MODE":
-				conn.mode(arguments[0])
+				conn.mode(arguments)
 			case "SYST":
 				conn.syst()
+			case "FEAT":
+				conn.feat()
+			case "CLNT":
+				conn.clnt(arguments)
+			case "OPTS":
+				conn.opts(arguments)
+			case "PBSZ":
+				conn.pbsz(arguments)
+			case "PROT":
+				conn.prot(arguments)
 			case "REIN":
-				conn.ctx = newUserContext()
+				conn.resetLogin()
+				conn.discardDataConnection()
+				conn.ctx = conn.ctx.reinitialize()
+				conn.hashRange = nil
+				conn.expectedHash = ""
 				conn.sendReply(200, "Command Okay.")
+			case "SITE":
+				conn.site(arguments)
 			case "NOOP":
 				conn.sendReply(200, "Command okay.")
 			case "QUIT":
@@ -98,17 +203,50 @@ func (conn *ftpConnection) handleCommand(command string, arguments []string) boo
 			}
 		}
 	}
-	conn.sendReply(530, "Not logged in.")
 	return false
 }
 
 func handleFTPConnection(conn *ftpConnection) {
+	// Every exit path closes the control connection and frees the slots held by it
+	defer conn.control.Close()
+	ip := conn.remoteIP()
+	if !connectionAllowed(ip) {
+		emitEvent(Event{
+			Kind:     EventConnectionRejected,
+			RemoteIP: ip,
+			Message:  "Connection from " + ip + " refused by IP filter",
+		})
+		conn.sendReply(421, "Service not available, closing control connection.")
+		return
+	}
+	if !acquireSession(ip) {
+		conn.sendReply(421, connectionLimitMessage())
+		return
+	}
+	defer releaseSession(ip)
+	defer conn.logout()
+	defer conn.discardDataConnection()
+	defer conn.closePassive()
+
+	if conn.tlsConn != nil {
+		if notok := utils.HandleWarning(nil, conn.tlsConn.Handshake()); notok {
+			return
+		}
+		state := conn.tlsConn.ConnectionState()
+		conn.ctx.TLSState = &state
+		conn.identifyClientCertificate()
+	}
+
 	welcome, err := globalDriver.Welcome(conn.ctx)
 	if err != nil {
-		conn.sendReply(500, "Syntax error, command unrecognized.")
+		conn.sendReply(421, err.Error())
 		return
 	}
+	defer func() {
+		globalDriver.Bye(conn.ctx)
+	}()
 	conn.sendReply(220, welcome)
+	conn.certLogin()
 
 	r := bufio.NewReader(conn.control)
 	for {
@@ -117,52 +255,97 @@ func handleFTPConnection(conn *ftpConnection) {
 		log.Println("user (" + conn.control.RemoteAddr().String() + "): " + command)
 		if notok := utils.HandleWarning(func() {
 			log.Println("Terminating connection with host: " + conn.control.RemoteAddr().String())
-			conn.control.Close()
 		}, err); notok {
 			return
 		}
 		args := strings.Split(command, " ")
 		comm := args[0]
 		args = args[1:]
-		if quit := conn.handleCommand(comm, args); quit {
-			globalDriver.Bye(conn.ctx)
-			return
-		}
+		// QUIT closes the control connection once ongoing transfers conclude, which ends
+		// this loop through the read error above
+		conn.handleCommand(comm, args)
 	}
 }
 
 // StartServer creates FTP server and configures it according to the supplied driver
 func StartServer(driver ServerDriver) {
+	utils.HandleFatalError(nil, configureServer(driver))
+
+	listener, err := net.Listen("tcp4", ":"+strconv.Itoa(globalServerSettings.ListeningPort))
+	log.Println("Starting server ... ")
+	utils.HandleFatalError(nil, err)
+	utils.HandleFatalError(nil, serve(listener))
+}
+
+// Serve configures the server according to the supplied driver and serves the control
+// connections accepted by `listener` (e.g. on a random port in tests) until it is closed
+func Serve(listener net.Listener, driver ServerDriver) error {
+	if err := configureServer(driver); err != nil {
+		return err
+	}
+	return serve(listener)
+}
+
+// configureServer applies the settings of the supplied driver
+func configureServer(driver ServerDriver) error {
 	globalDriver = driver
 
 	var err error
 	globalServerSettings, err = driver.GetSettings()
-	utils.HandleFatalError(nil, err)
+	if err != nil {
+		return err
+	}
+	globalLock.Lock()
+	freeListenerPorts = freeListenerPorts[:0]
 	for i := globalServerSettings.DataPortRange.start; i <= globalServerSettings.DataPortRange.end; i++ {
 		freeListenerPorts = append(freeListenerPorts, i)
 	}
+	globalLock.Unlock()
+	SetGlobalRateLimits(globalServerSettings.GlobalRateLimits)
+	SetIPFilter(globalServerSettings.IPFilter)
+	SetUserIPFilters(globalServerSettings.UserIPFilters)
+	globalHashes = newFileCache(globalServerSettings.HashCacheSize)
+	globalStorage = globalServerSettings.Storage
+	if globalStorage == nil {
+		globalStorage = LocalStorage{}
+	}
 
 	globalAccessControlSettings, err = driver.GetAccessControlSettings()
-	utils.HandleFatalError(nil, err)
-
-	listener, err := net.Listen("tcp4", ":"+strconv.Itoa(globalServerSettings.ListeningPort))
-	log.Println("Starting server ... ")
-	utils.HandleFatalError(nil, err)
+	if err != nil {
+		return err
+	}
 
-	tlsConfig, err := driver.GetTLSConfig()
+	globalTLSConfig, err = driver.GetTLSConfig()
 	utils.HandleWarning(nil, err)
-	if tlsConfig != nil {
-		listener = tls.NewListener(listener, tlsConfig)
+	return nil
+}
+
+// serve handles the control connections accepted by `listener` until it is closed
+func serve(listener net.Listener) error {
+	if globalTLSConfig != nil {
+		listener = tls.NewListener(listener, globalTLSConfig)
 	}
 
 	for {
 		con, err := listener.Accept()
-		utils.HandleFatalError(nil, err)
+		if err != nil {
+			return err
+		}
 		control, err := telnet.NewConn(con)
-		utils.HandleFatalError(nil, err)
+		if err != nil {
+			return err
+		}
 		conn := &ftpConnection{
-			control: control,
-			ctx:     newUserContext(),
+			control:   control,
+			ctx:       newUserContext(),
+			zlibLevel: zlib.DefaultCompression,
+		}
+		conn.ctx.SessionID = newSessionID()
+		conn.ctx.RemoteAddr = con.RemoteAddr()
+		conn.ctx.LocalAddr = con.LocalAddr()
+		conn.ctx.ConnectTime = time.Now()
+		if tlsConn, ok := con.(*tls.Conn); ok {
+			conn.tlsConn = tlsConn
 		}
 		go handleFTPConnection(conn)
 	}
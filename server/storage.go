@@ -0,0 +1,180 @@
+package server
+
+import (
+	"io"
+	"os"
+	"time"
+
+	"github.com/Charana123/ftp/utils"
+)
+
+// Storage is the filesystem holding the files served over FTP. Paths are absolute and
+// slash separated, and have already been checked against the access control rules.
+// Errors satisfying os.IsNotExist are reported to the user as unavailable files.
+type Storage interface {
+	// Stat returns information about a file or directory
+	Stat(path string) (os.FileInfo, error)
+	// ReadDir returns the entries of a directory sorted by name
+	ReadDir(path string) ([]os.FileInfo, error)
+	// Open opens a file for reading from `offset`
+	Open(path string, offset int64) (io.ReadCloser, error)
+	// Create opens a file for writing from `offset`, creating it if needed and discarding
+	// its contents from `offset` on. The file is only complete once Close succeeds.
+	Create(path string, offset int64) (io.WriteCloser, error)
+	// Remove deletes a file or an empty directory
+	Remove(path string) error
+	// Rename moves a file or directory
+	Rename(from string, to string) error
+	// Mkdir creates a directory
+	Mkdir(path string) error
+	// Chtimes sets the modification time of a file or directory
+	Chtimes(path string, modTime time.Time) error
+}
+
+// CreationTimeStorage is optionally implemented by a Storage able to set creation times (MFCT)
+type CreationTimeStorage interface {
+	SetCreationTime(path string, creationTime time.Time) error
+}
+
+// XattrStorage is optionally implemented by a Storage able to set extended attributes
+type XattrStorage interface {
+	SetXattr(path string, name string, value []byte) error
+}
+
+// ReadOnlyStorage is optionally implemented by a Storage to tell which paths it rejects
+// changes to, so that listings do not offer them
+type ReadOnlyStorage interface {
+	ReadOnly(path string) bool
+}
+
+// WrapperStorage is optionally implemented by a Storage serving its files from other
+// storages, so that the optional features of the storage holding a file can be found
+type WrapperStorage interface {
+	// Unwrap returns the storage serving `path` and the path of the file in it, or nil if
+	// no storage serves it
+	Unwrap(path string) (Storage, string)
+}
+
+// AbortableWriter is optionally implemented by the writers of Storage.Create committing a
+// file only once closed, to discard the file of a failed upload instead
+type AbortableWriter interface {
+	Abort() error
+}
+
+// abortWrite discards the file of a failed upload if its storage allows it, closing it otherwise
+func abortWrite(file io.WriteCloser) error {
+	if w, ok := file.(AbortableWriter); ok {
+		return w.Abort()
+	}
+	return file.Close()
+}
+
+// storage returns the Storage serving the files of this connection
+func (conn *ftpConnection) storage() Storage {
+	if conn.userStorage != nil {
+		return conn.userStorage
+	}
+	return globalStorage
+}
+
+// loadUserStorage asks the driver, if it supports it, for the mounts and the encryption
+// key of the user about to log in, returning false if they could not be obtained
+func (conn *ftpConnection) loadUserStorage() bool {
+	conn.userStorage = nil
+	var storage Storage
+	if mountDriver, ok := globalDriver.(MountDriver); ok {
+		mounts, err := mountDriver.GetUserMounts(conn.ctx)
+		if notok := utils.HandleWarning(nil, err); notok {
+			return false
+		}
+		if mounts != nil {
+			storage = mounts
+		}
+	}
+	if keyDriver, ok := globalDriver.(EncryptionKeyDriver); ok {
+		key, err := keyDriver.GetEncryptionKey(conn.ctx)
+		if notok := utils.HandleWarning(nil, err); notok {
+			return false
+		}
+		if key != nil {
+			if storage == nil {
+				storage = globalStorage
+			}
+			// Mounts are encrypted one by one, skipping read-only storages of plaintext files
+			switch s := storage.(type) {
+			case *MountTable:
+				storage, err = s.encrypted(key)
+			case ReadOnlyStorage:
+				if !s.ReadOnly("/") {
+					storage, err = NewEncryptedStorage(storage, key)
+				}
+			default:
+				storage, err = NewEncryptedStorage(storage, key)
+			}
+			if notok := utils.HandleWarning(nil, err); notok {
+				return false
+			}
+		}
+	}
+	conn.userStorage = storage
+	return true
+}
+
+// cacheKey returns the key under which data about a file is cached, which differs between
+// users with their own storage as the same path may be a different file for each
+func (conn *ftpConnection) cacheKey(filePath string) string {
+	if conn.userStorage != nil {
+		return conn.loginUser + "\x00" + filePath
+	}
+	return filePath
+}
+
+// findStorage returns the first storage accepted by `match`, from the Storage of this
+// connection down through the storages serving `filePath` it wraps, along with the path
+// of the file in it
+func (conn *ftpConnection) findStorage(filePath string, match func(storage Storage, filePath string) bool) (Storage, string, bool) {
+	storage := conn.storage()
+	for storage != nil {
+		if match(storage, filePath) {
+			return storage, filePath, true
+		}
+		wrapper, ok := storage.(WrapperStorage)
+		if !ok {
+			break
+		}
+		storage, filePath = wrapper.Unwrap(filePath)
+	}
+	return nil, "", false
+}
+
+// creationTimeStorage returns the Storage of this connection if it can set the creation
+// time of `filePath`, which the storage holding the file must support
+func (conn *ftpConnection) creationTimeStorage(filePath string) (CreationTimeStorage, bool) {
+	storage, ok := conn.storage().(CreationTimeStorage)
+	if !ok {
+		return nil, false
+	}
+	holder, _, ok := conn.findStorage(filePath, func(storage Storage, _ string) bool {
+		_, wrapper := storage.(WrapperStorage)
+		return !wrapper
+	})
+	if !ok {
+		return nil, false
+	}
+	if _, local := holder.(LocalStorage); local && !creationTimeSupported {
+		return nil, false
+	}
+	if _, ok := holder.(CreationTimeStorage); !ok {
+		return nil, false
+	}
+	return storage, true
+}
+
+// writable reports whether the storages serving `path` accept changes to it
+func (conn *ftpConnection) writable(path string) bool {
+	_, _, readOnly := conn.findStorage(path, func(storage Storage, filePath string) bool {
+		readOnlyStorage, ok := storage.(ReadOnlyStorage)
+		return ok && readOnlyStorage.ReadOnly(filePath)
+	})
+	return !readOnly
+}
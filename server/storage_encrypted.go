@@ -0,0 +1,359 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+const (
+	// encryptedMagic starts every file written by an EncryptedStorage
+	encryptedMagic = "FTPENC01"
+	// encryptedSaltSize is the size of the random salt from which the key of each file is derived
+	encryptedSaltSize = 16
+	// encryptedHeaderSize is the size of the magic and salt preceding the chunks
+	encryptedHeaderSize = len(encryptedMagic) + encryptedSaltSize
+	// encryptedChunkSize is the plaintext size of every chunk but the last
+	encryptedChunkSize = 64 * 1024
+	// encryptedChunkOverhead is the nonce and authentication tag added to each chunk
+	encryptedChunkOverhead = 12 + 16
+)
+
+// ErrDecryption is returned when reading a file that was not written with the key of the
+// EncryptedStorage, or that was modified or truncated since
+var ErrDecryption = errors.New("file cannot be decrypted")
+
+// EncryptionKeyDriver is optionally implemented by a ServerDriver to encrypt the files
+// stored by each user with its own key
+type EncryptionKeyDriver interface {
+	// GetEncryptionKey returns the 256-bit key encrypting the files of the user that just
+	// logged in, or nil to store them in plaintext. Failing to provide it fails the login.
+	// The storage of each mount of the user is encrypted, except read-only storages, whose
+	// files cannot have been written with the key.
+	GetEncryptionKey(ctx *UserContext) ([]byte, error)
+}
+
+// EncryptedStorage wraps a Storage to encrypt the contents of files with AES-256-GCM.
+// Files are split in 64 KiB chunks, each authenticated along with its position and
+// whether it ends the file, so that reordered or truncated chunks are detected. Sizes
+// are reported as plaintext sizes, and reads and resumed uploads (REST) start from the
+// chunk holding the requested offset. File names and times are not encrypted.
+type EncryptedStorage struct {
+	Storage
+	key []byte
+}
+
+// NewEncryptedStorage creates an EncryptedStorage encrypting the files of `storage` with
+// a 256-bit `key`
+func NewEncryptedStorage(storage Storage, key []byte) (*EncryptedStorage, error) {
+	if len(key) != 32 {
+		return nil, errors.New("encryption key must be 32 bytes")
+	}
+	return &EncryptedStorage{Storage: storage, key: key}, nil
+}
+
+// plaintextSize returns the size of the contents of an encrypted file of `size` bytes
+func plaintextSize(size int64) int64 {
+	size -= int64(encryptedHeaderSize)
+	if size <= 0 {
+		return 0
+	}
+	full := size / (encryptedChunkSize + encryptedChunkOverhead)
+	last := size % (encryptedChunkSize + encryptedChunkOverhead)
+	if last > encryptedChunkOverhead {
+		last -= encryptedChunkOverhead
+	} else {
+		last = 0
+	}
+	return full*encryptedChunkSize + last
+}
+
+// chunkOffset returns the offset of a chunk in an encrypted file
+func chunkOffset(index int64) int64 {
+	return int64(encryptedHeaderSize) + index*(encryptedChunkSize+encryptedChunkOverhead)
+}
+
+func (e *EncryptedStorage) Stat(path string) (os.FileInfo, error) {
+	info, err := e.Storage.Stat(path)
+	if err != nil || info.IsDir() {
+		return info, err
+	}
+	return &encryptedInfo{FileInfo: info}, nil
+}
+
+func (e *EncryptedStorage) ReadDir(path string) ([]os.FileInfo, error) {
+	infos, err := e.Storage.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	for i, info := range infos {
+		if !info.IsDir() {
+			infos[i] = &encryptedInfo{FileInfo: info}
+		}
+	}
+	return infos, nil
+}
+
+// Open decrypts a file from the chunk holding `offset`
+func (e *EncryptedStorage) Open(path string, offset int64) (io.ReadCloser, error) {
+	aead, err := e.fileCipher(path)
+	if err != nil {
+		return nil, err
+	}
+	// Reading from the end of a chunk checks whether it ends the file
+	index := int64(0)
+	if offset > 0 {
+		index = (offset - 1) / encryptedChunkSize
+	}
+	file, err := e.Storage.Open(path, chunkOffset(index))
+	if err != nil {
+		return nil, err
+	}
+	r := &decrypter{file: file, src: bufio.NewReader(file), aead: aead, index: index}
+	// Skip the start of the first chunk
+	if _, err := io.CopyN(ioutil.Discard, r, offset-index*encryptedChunkSize); err != nil {
+		file.Close()
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, &os.PathError{Op: "open", Path: path, Err: err}
+	}
+	return r, nil
+}
+
+// Create encrypts a file as it is written. Writing from an offset re-encrypts the start of
+// the chunk holding it, under a new nonce.
+func (e *EncryptedStorage) Create(path string, offset int64) (io.WriteCloser, error) {
+	if offset == 0 {
+		salt := make([]byte, encryptedSaltSize)
+		if _, err := rand.Read(salt); err != nil {
+			return nil, err
+		}
+		file, err := e.Storage.Create(path, 0)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := file.Write(append([]byte(encryptedMagic), salt...)); err != nil {
+			file.Close()
+			return nil, err
+		}
+		return &encrypter{file: file, aead: e.chunkCipher(salt)}, nil
+	}
+
+	// The chunk ending at a chunk boundary is rewritten too, as it no longer ends the file
+	index := (offset - 1) / encryptedChunkSize
+	start := index * encryptedChunkSize
+	prefix := bytes.Buffer{}
+	r, err := e.Open(path, start)
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.CopyN(&prefix, r, offset-start)
+	r.Close()
+	if err == io.EOF {
+		err = errors.New("offset beyond the end of the file")
+	}
+	if err != nil {
+		return nil, &os.PathError{Op: "create", Path: path, Err: err}
+	}
+	aead, err := e.fileCipher(path)
+	if err != nil {
+		return nil, err
+	}
+	file, err := e.Storage.Create(path, chunkOffset(index))
+	if err != nil {
+		return nil, err
+	}
+	return &encrypter{file: file, aead: aead, index: index, buffer: prefix.Bytes()}, nil
+}
+
+func (e *EncryptedStorage) SetCreationTime(path string, creationTime time.Time) error {
+	storage, ok := e.Storage.(CreationTimeStorage)
+	if !ok {
+		return errors.New("storage does not support creation times")
+	}
+	return storage.SetCreationTime(path, creationTime)
+}
+
+func (e *EncryptedStorage) SetXattr(path string, name string, value []byte) error {
+	storage, ok := e.Storage.(XattrStorage)
+	if !ok {
+		return errors.New("storage does not support extended attributes")
+	}
+	return storage.SetXattr(path, name, value)
+}
+
+func (e *EncryptedStorage) ReadOnly(path string) bool {
+	storage, ok := e.Storage.(ReadOnlyStorage)
+	return ok && storage.ReadOnly(path)
+}
+
+// Unwrap returns the wrapped storage
+func (e *EncryptedStorage) Unwrap(path string) (Storage, string) {
+	return e.Storage, path
+}
+
+// fileCipher reads the header of an encrypted file and returns the cipher of its chunks
+func (e *EncryptedStorage) fileCipher(path string) (cipher.AEAD, error) {
+	file, err := e.Storage.Open(path, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	header := make([]byte, encryptedHeaderSize)
+	if _, err := io.ReadFull(file, header); err != nil || string(header[:len(encryptedMagic)]) != encryptedMagic {
+		return nil, &os.PathError{Op: "open", Path: path, Err: ErrDecryption}
+	}
+	return e.chunkCipher(header[len(encryptedMagic):]), nil
+}
+
+// chunkCipher returns the cipher of the chunks of a file, keyed by the storage key and
+// the salt of the file
+func (e *EncryptedStorage) chunkCipher(salt []byte) cipher.AEAD {
+	mac := hmac.New(sha256.New, e.key)
+	mac.Write(salt)
+	// Keys of 32 bytes and the standard nonce size cannot fail
+	block, _ := aes.NewCipher(mac.Sum(nil))
+	aead, _ := cipher.NewGCM(block)
+	return aead
+}
+
+// chunkData returns the data authenticated with a chunk besides its contents
+func chunkData(index int64, last bool) []byte {
+	data := make([]byte, 9)
+	binary.BigEndian.PutUint64(data, uint64(index))
+	if last {
+		data[8] = 1
+	}
+	return data
+}
+
+// encrypter encrypts the chunks of a file as they are written
+type encrypter struct {
+	file   io.WriteCloser
+	aead   cipher.AEAD
+	index  int64
+	buffer []byte
+}
+
+func (w *encrypter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		// A full chunk is only written once more data shows it does not end the file
+		if len(w.buffer) == encryptedChunkSize {
+			if err := w.flush(false); err != nil {
+				return written, err
+			}
+		}
+		n := encryptedChunkSize - len(w.buffer)
+		if n > len(p) {
+			n = len(p)
+		}
+		w.buffer = append(w.buffer, p[:n]...)
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// flush writes the buffered chunk
+func (w *encrypter) flush(last bool) error {
+	nonce := make([]byte, w.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	chunk := w.aead.Seal(nonce, nonce, w.buffer, chunkData(w.index, last))
+	if _, err := w.file.Write(chunk); err != nil {
+		return err
+	}
+	w.index++
+	w.buffer = w.buffer[:0]
+	return nil
+}
+
+// Close writes the last chunk, empty for an empty file
+func (w *encrypter) Close() error {
+	if err := w.flush(true); err != nil {
+		w.file.Close()
+		return err
+	}
+	return w.file.Close()
+}
+
+// Abort discards the file without writing the last chunk, if the wrapped storage allows it
+func (w *encrypter) Abort() error {
+	return abortWrite(w.file)
+}
+
+// decrypter decrypts the chunks of a file as they are read
+type decrypter struct {
+	file   io.Closer
+	src    *bufio.Reader
+	aead   cipher.AEAD
+	index  int64
+	buffer []byte
+	done   bool
+}
+
+func (r *decrypter) Read(p []byte) (int, error) {
+	for len(r.buffer) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.buffer)
+	r.buffer = r.buffer[n:]
+	return n, nil
+}
+
+// next decrypts the next chunk, which is the last if nothing follows it
+func (r *decrypter) next() error {
+	chunk := make([]byte, encryptedChunkSize+encryptedChunkOverhead)
+	n, err := io.ReadFull(r.src, chunk)
+	if err == io.ErrUnexpectedEOF || err == io.EOF {
+		r.done = true
+	} else if err != nil {
+		return err
+	} else if _, err := r.src.Peek(1); err == io.EOF {
+		r.done = true
+	} else if err != nil {
+		return err
+	}
+	if n < encryptedChunkOverhead {
+		return ErrDecryption
+	}
+	nonceSize := r.aead.NonceSize()
+	plaintext, err := r.aead.Open(nil, chunk[:nonceSize], chunk[nonceSize:n], chunkData(r.index, r.done))
+	if err != nil {
+		return ErrDecryption
+	}
+	r.index++
+	r.buffer = plaintext
+	return nil
+}
+
+func (r *decrypter) Close() error {
+	return r.file.Close()
+}
+
+// encryptedInfo reports the plaintext size of an encrypted file
+type encryptedInfo struct {
+	os.FileInfo
+}
+
+func (ei *encryptedInfo) Size() int64 {
+	return plaintextSize(ei.FileInfo.Size())
+}
@@ -0,0 +1,187 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+
+	"github.com/Charana123/ftp/server/memfs"
+)
+
+var testKey = []byte("0123456789abcdef0123456789abcdef")
+
+func newEncryptedStorage(t *testing.T, storage Storage, key []byte) *EncryptedStorage {
+	t.Helper()
+	encrypted, err := NewEncryptedStorage(storage, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return encrypted
+}
+
+// randomData returns `size` reproducible random bytes
+func randomData(size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(int64(size))).Read(data)
+	return data
+}
+
+// writeFile writes a file in small pieces, as from a data connection
+func writeFile(t *testing.T, storage Storage, name string, offset int64, data []byte) {
+	t.Helper()
+	w, err := storage.Create(name, offset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for len(data) > 0 {
+		n := 1000
+		if n > len(data) {
+			n = len(data)
+		}
+		if _, err := w.Write(data[:n]); err != nil {
+			t.Fatal(err)
+		}
+		data = data[n:]
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readFile(storage Storage, name string, offset int64) ([]byte, error) {
+	r, err := storage.Open(name, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+func TestEncryptedRoundTrip(t *testing.T) {
+	fs := memfs.New()
+	storage := newEncryptedStorage(t, fs, testKey)
+	for _, size := range []int{0, 1, encryptedChunkSize - 1, encryptedChunkSize, encryptedChunkSize + 1, 3*encryptedChunkSize + 5} {
+		data := randomData(size)
+		writeFile(t, storage, "/file", 0, data)
+		got, err := readFile(storage, "/file", 0)
+		if err != nil || !bytes.Equal(got, data) {
+			t.Errorf("%d bytes: read %d bytes, %v", size, len(got), err)
+		}
+
+		raw, _ := readFile(fs, "/file", 0)
+		if size > 0 && bytes.Contains(raw, data[:(size+1)/2]) {
+			t.Errorf("%d bytes: plaintext stored", size)
+		}
+		// Sizes of encrypted files agree with what is read from them
+		if plaintextSize(int64(len(raw))) != int64(len(got)) {
+			t.Errorf("%d bytes: plaintextSize(%d) = %d", size, len(raw), plaintextSize(int64(len(raw))))
+		}
+		info, err := storage.Stat("/file")
+		if err != nil || info.Size() != int64(size) {
+			t.Errorf("%d bytes: Stat = %v, %v", size, info, err)
+		}
+		infos, err := storage.ReadDir("/")
+		if err != nil || len(infos) != 1 || infos[0].Size() != int64(size) {
+			t.Errorf("%d bytes: ReadDir = %v, %v", size, infos, err)
+		}
+	}
+}
+
+func TestEncryptedOffsets(t *testing.T) {
+	storage := newEncryptedStorage(t, memfs.New(), testKey)
+	data := randomData(3*encryptedChunkSize + 100)
+	offsets := []int64{0, 1, 100, encryptedChunkSize - 1, encryptedChunkSize, encryptedChunkSize + 1,
+		2 * encryptedChunkSize, 3 * encryptedChunkSize, int64(len(data)) - 1, int64(len(data))}
+
+	writeFile(t, storage, "/file", 0, data)
+	for _, offset := range offsets {
+		if got, err := readFile(storage, "/file", offset); err != nil || !bytes.Equal(got, data[offset:]) {
+			t.Errorf("Open from %d: read %d bytes, %v", offset, len(got), err)
+		}
+	}
+	if _, err := storage.Open("/file", int64(len(data))+1); err == nil {
+		t.Error("Open beyond the end succeeded")
+	}
+
+	// Resumed uploads keep the contents before the offset, whatever follows it
+	tail := randomData(encryptedChunkSize + 7)
+	for _, offset := range offsets {
+		writeFile(t, storage, "/file", 0, data)
+		writeFile(t, storage, "/file", offset, tail)
+		want := append(append([]byte{}, data[:offset]...), tail...)
+		if got, err := readFile(storage, "/file", 0); err != nil || !bytes.Equal(got, want) {
+			t.Errorf("Create from %d: read %d bytes, %v, want %d bytes", offset, len(got), err, len(want))
+		}
+		if info, err := storage.Stat("/file"); err != nil || info.Size() != int64(len(want)) {
+			t.Errorf("Create from %d: Stat = %v, %v", offset, info, err)
+		}
+	}
+	if _, err := storage.Create("/file", int64(len(data)+len(tail))+1); err == nil {
+		t.Error("Create beyond the end succeeded")
+	}
+}
+
+func TestEncryptedTampering(t *testing.T) {
+	fs := memfs.New()
+	storage := newEncryptedStorage(t, fs, testKey)
+	writeFile(t, storage, "/file", 0, randomData(2*encryptedChunkSize+100))
+	raw, _ := readFile(fs, "/file", 0)
+	chunk := func(index int64) []byte {
+		end := chunkOffset(index + 1)
+		if end > int64(len(raw)) {
+			end = int64(len(raw))
+		}
+		return raw[chunkOffset(index):end]
+	}
+	flip := func(i int) []byte {
+		tampered := append([]byte{}, raw...)
+		tampered[i] ^= 1
+		return tampered
+	}
+	join := func(parts ...[]byte) []byte {
+		return bytes.Join(parts, nil)
+	}
+	header := raw[:encryptedHeaderSize]
+
+	for name, tampered := range map[string][]byte{
+		"truncated at a chunk boundary": raw[:chunkOffset(2)],
+		"truncated in a chunk":          raw[:len(raw)-10],
+		"truncated in a nonce":          raw[:chunkOffset(2)+5],
+		"header only":                   header,
+		"reordered chunks":              join(header, chunk(1), chunk(0), chunk(2)),
+		"repeated chunk":                join(header, chunk(0), chunk(0), chunk(1), chunk(2)),
+		"dropped chunk":                 join(header, chunk(0), chunk(2)),
+		"tampered ciphertext":           flip(int(chunkOffset(1)) + 100),
+		"tampered nonce":                flip(int(chunkOffset(2)) + 1),
+		"tampered salt":                 flip(len(encryptedMagic) + 1),
+		"tampered magic":                flip(0),
+		"plaintext":                     []byte("plaintext file written around the storage"),
+		"empty":                         {},
+	} {
+		if err := fs.WriteFile("/tampered", tampered, 0644); err != nil {
+			t.Fatal(err)
+		}
+		// Read whole or from the second chunk on
+		offset := int64(encryptedChunkSize + 1)
+		if size := plaintextSize(int64(len(tampered))); size < offset {
+			offset = size
+		}
+		for _, offset := range []int64{0, offset} {
+			if _, err := readFile(storage, "/tampered", offset); !errors.Is(err, ErrDecryption) {
+				t.Errorf("%s: read from %d = %v, want ErrDecryption", name, offset, err)
+			}
+		}
+	}
+
+	other := newEncryptedStorage(t, fs, []byte("another key of thirty-two bytes!"))
+	for _, offset := range []int64{0, encryptedChunkSize + 1} {
+		if _, err := readFile(other, "/file", offset); !errors.Is(err, ErrDecryption) {
+			t.Errorf("read with the wrong key from %d = %v, want ErrDecryption", offset, err)
+		}
+	}
+	if _, err := NewEncryptedStorage(fs, testKey[:16]); err == nil {
+		t.Error("NewEncryptedStorage with a 128-bit key succeeded")
+	}
+}
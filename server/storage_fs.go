@@ -0,0 +1,99 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// ErrReadOnly is returned by the storages that reject any change to their files
+var ErrReadOnly = errors.New("read-only storage")
+
+// FSStorage serves the files of an io/fs.FS, such as an embed.FS, a zip.Reader or an
+// os.DirFS, as a read-only Storage. The root of the FS is the FTP path "/".
+type FSStorage struct {
+	fsys fs.FS
+}
+
+// NewFSStorage creates a read-only Storage serving the files of `fsys`
+func NewFSStorage(fsys fs.FS) *FSStorage {
+	return &FSStorage{fsys: fsys}
+}
+
+// fsPath converts an absolute FTP path to the unrooted form used by io/fs
+func fsPath(name string) string {
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	if name == "" {
+		return "."
+	}
+	return name
+}
+
+func (s *FSStorage) Stat(name string) (os.FileInfo, error) {
+	return fs.Stat(s.fsys, fsPath(name))
+}
+
+func (s *FSStorage) ReadDir(name string) ([]os.FileInfo, error) {
+	entries, err := fs.ReadDir(s.fsys, fsPath(name))
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]os.FileInfo, 0, len(entries))
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+func (s *FSStorage) Open(name string, offset int64) (io.ReadCloser, error) {
+	file, err := s.fsys.Open(fsPath(name))
+	if err != nil {
+		return nil, err
+	}
+	if offset > 0 {
+		// Files of compressed archives cannot seek, their start is read and discarded
+		if seeker, ok := file.(io.Seeker); ok {
+			_, err = seeker.Seek(offset, io.SeekStart)
+		} else {
+			_, err = io.CopyN(io.Discard, file, offset)
+		}
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	return file, nil
+}
+
+func (s *FSStorage) Create(name string, offset int64) (io.WriteCloser, error) {
+	return nil, &os.PathError{Op: "create", Path: name, Err: ErrReadOnly}
+}
+
+func (s *FSStorage) Remove(name string) error {
+	return &os.PathError{Op: "remove", Path: name, Err: ErrReadOnly}
+}
+
+func (s *FSStorage) Rename(from string, to string) error {
+	return &os.LinkError{Op: "rename", Old: from, New: to, Err: ErrReadOnly}
+}
+
+func (s *FSStorage) Mkdir(name string) error {
+	return &os.PathError{Op: "mkdir", Path: name, Err: ErrReadOnly}
+}
+
+func (s *FSStorage) Chtimes(name string, modTime time.Time) error {
+	return &os.PathError{Op: "chtimes", Path: name, Err: ErrReadOnly}
+}
+
+// ReadOnly tells that no file of the storage can be changed
+func (s *FSStorage) ReadOnly(name string) bool {
+	return true
+}
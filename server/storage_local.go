@@ -0,0 +1,77 @@
+package server
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// LocalStorage is the Storage of the local filesystem, where FTP paths are OS paths
+type LocalStorage struct{}
+
+func (LocalStorage) Stat(path string) (os.FileInfo, error) {
+	return os.Stat(filepath.FromSlash(path))
+}
+
+func (LocalStorage) ReadDir(path string) ([]os.FileInfo, error) {
+	return ioutil.ReadDir(filepath.FromSlash(path))
+}
+
+func (LocalStorage) Open(path string, offset int64) (io.ReadCloser, error) {
+	file, err := os.Open(filepath.FromSlash(path))
+	if err != nil {
+		return nil, err
+	}
+	if offset > 0 {
+		if _, err := file.Seek(offset, io.SeekStart); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	return file, nil
+}
+
+func (LocalStorage) Create(path string, offset int64) (io.WriteCloser, error) {
+	if offset == 0 {
+		return os.Create(filepath.FromSlash(path))
+	}
+	file, err := os.OpenFile(filepath.FromSlash(path), os.O_WRONLY|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+	if err := file.Truncate(offset); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+func (LocalStorage) Remove(path string) error {
+	return os.Remove(filepath.FromSlash(path))
+}
+
+func (LocalStorage) Rename(from string, to string) error {
+	return os.Rename(filepath.FromSlash(from), filepath.FromSlash(to))
+}
+
+func (LocalStorage) Mkdir(path string) error {
+	return os.Mkdir(filepath.FromSlash(path), 0777)
+}
+
+func (LocalStorage) Chtimes(path string, modTime time.Time) error {
+	return os.Chtimes(filepath.FromSlash(path), time.Now(), modTime)
+}
+
+func (LocalStorage) SetCreationTime(path string, creationTime time.Time) error {
+	return setCreationTime(filepath.FromSlash(path), creationTime)
+}
+
+func (LocalStorage) SetXattr(path string, name string, value []byte) error {
+	return setXattr(filepath.FromSlash(path), name, value)
+}
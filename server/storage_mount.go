@@ -0,0 +1,405 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ErrCrossMount is returned when renaming between the storages of a MountTable without
+// MountSettings.CopyAcrossMounts
+var ErrCrossMount = errors.New("rename across mount points")
+
+// errMountPoint is returned when removing or renaming a mount point or a directory above one
+var errMountPoint = errors.New("mount point")
+
+// Mount attaches a Storage to a directory of the FTP tree
+type Mount struct {
+	// Path of the mount point, e.g. "/srv/ftp/archive"
+	Path string
+	// Storage serving the files under the mount point
+	Storage Storage
+	// Directory of the storage served at the mount point, "/" if empty. For instance the
+	// files of LocalStorage under "/var/spool/incoming", or the keys under "archive/" of
+	// an S3 bucket.
+	Root string
+}
+
+// MountSettings configures a MountTable
+type MountSettings struct {
+	// Renames between mounts copy the files to the destination then delete them, instead
+	// of failing with ErrCrossMount. Such renames are not atomic.
+	CopyAcrossMounts bool
+}
+
+// MountTable assembles a single tree from several storages. Each path is served by the
+// mount with the longest path containing it, and mount points show up in the listings of
+// their parent directory even if the storage serving it has no such directory.
+type MountTable struct {
+	// Longest path first
+	mounts   []Mount
+	settings MountSettings
+}
+
+// MountDriver is optionally implemented by a ServerDriver to give each user its own tree
+type MountDriver interface {
+	// GetUserMounts returns the mounts seen by the user that just logged in, or nil for
+	// ServerSettings.Storage. Failing to provide them fails the login.
+	GetUserMounts(ctx *UserContext) (*MountTable, error)
+}
+
+// NewMountTable creates a MountTable of `mounts`
+func NewMountTable(mounts []Mount, settings MountSettings) *MountTable {
+	t := &MountTable{settings: settings}
+	for _, mount := range mounts {
+		mount.Path = path.Clean("/" + mount.Path)
+		mount.Root = path.Clean("/" + mount.Root)
+		t.mounts = append(t.mounts, mount)
+	}
+	sort.SliceStable(t.mounts, func(i, j int) bool { return len(t.mounts[i].Path) > len(t.mounts[j].Path) })
+	return t
+}
+
+// resolve returns the mount serving `filePath` and the path of the file in its storage
+func (t *MountTable) resolve(filePath string) (*Mount, string, bool) {
+	filePath = path.Clean("/" + filePath)
+	for i := range t.mounts {
+		mount := &t.mounts[i]
+		if rest, ok := underDirectory(filePath, mount.Path); ok {
+			return mount, path.Join(mount.Root, rest), true
+		}
+	}
+	return nil, "", false
+}
+
+// mountedBelow returns the names of the entries of a directory leading to mount points
+func (t *MountTable) mountedBelow(dirPath string) []string {
+	dirPath = path.Clean("/" + dirPath)
+	names := []string{}
+	seen := make(map[string]bool)
+	for _, mount := range t.mounts {
+		rest, ok := underDirectory(mount.Path, dirPath)
+		if !ok || rest == "" {
+			continue
+		}
+		name := strings.SplitN(rest, "/", 2)[0]
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// underDirectory returns the path of `filePath` relative to `dirPath` if it lies in it
+func underDirectory(filePath string, dirPath string) (string, bool) {
+	if filePath == dirPath {
+		return "", true
+	}
+	if dirPath == "/" {
+		return filePath[1:], true
+	}
+	if strings.HasPrefix(filePath, dirPath+"/") {
+		return filePath[len(dirPath)+1:], true
+	}
+	return "", false
+}
+
+// fixed reports whether a path is a mount point or a directory above one, which cannot be
+// removed or renamed
+func (t *MountTable) fixed(filePath string) bool {
+	filePath = path.Clean("/" + filePath)
+	for _, mount := range t.mounts {
+		if _, ok := underDirectory(mount.Path, filePath); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *MountTable) Stat(filePath string) (os.FileInfo, error) {
+	mount, storagePath, ok := t.resolve(filePath)
+	if ok {
+		info, err := mount.Storage.Stat(storagePath)
+		if err == nil && storagePath == mount.Root {
+			// The root of a storage may be named differently than its mount point
+			return &mountInfo{FileInfo: info, name: path.Base(path.Clean("/" + filePath))}, nil
+		} else if err == nil {
+			return info, nil
+		}
+		if !os.IsNotExist(err) || !t.fixed(filePath) {
+			return nil, err
+		}
+	} else if !t.fixed(filePath) {
+		return nil, &os.PathError{Op: "stat", Path: filePath, Err: os.ErrNotExist}
+	}
+	// Directories leading to mount points exist even if no storage holds them
+	return &mountInfo{name: path.Base(path.Clean("/" + filePath))}, nil
+}
+
+// ReadDir lists the entries of a directory in its storage together with the mount points
+// and directories leading to mount points it contains
+func (t *MountTable) ReadDir(dirPath string) ([]os.FileInfo, error) {
+	below := t.mountedBelow(dirPath)
+	infos := []os.FileInfo{}
+	if mount, storagePath, ok := t.resolve(dirPath); ok {
+		storageInfos, err := mount.Storage.ReadDir(storagePath)
+		if err != nil && (!os.IsNotExist(err) || len(below) == 0) {
+			return nil, err
+		}
+		infos = append(infos, storageInfos...)
+	} else if len(below) == 0 {
+		return nil, &os.PathError{Op: "readdir", Path: dirPath, Err: os.ErrNotExist}
+	}
+	for _, name := range below {
+		info, err := t.Stat(path.Join(dirPath, name))
+		if err != nil {
+			return nil, err
+		}
+		// Mount points hide the entries of the same name
+		for i := range infos {
+			if infos[i].Name() == name {
+				infos = append(infos[:i], infos[i+1:]...)
+				break
+			}
+		}
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+	return infos, nil
+}
+
+func (t *MountTable) Open(filePath string, offset int64) (io.ReadCloser, error) {
+	mount, storagePath, ok := t.resolve(filePath)
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: filePath, Err: os.ErrNotExist}
+	}
+	return mount.Storage.Open(storagePath, offset)
+}
+
+func (t *MountTable) Create(filePath string, offset int64) (io.WriteCloser, error) {
+	mount, storagePath, ok := t.resolve(filePath)
+	if !ok {
+		return nil, &os.PathError{Op: "create", Path: filePath, Err: os.ErrNotExist}
+	}
+	return mount.Storage.Create(storagePath, offset)
+}
+
+func (t *MountTable) Remove(filePath string) error {
+	if t.fixed(filePath) {
+		return &os.PathError{Op: "remove", Path: filePath, Err: errMountPoint}
+	}
+	mount, storagePath, ok := t.resolve(filePath)
+	if !ok {
+		return &os.PathError{Op: "remove", Path: filePath, Err: os.ErrNotExist}
+	}
+	return mount.Storage.Remove(storagePath)
+}
+
+// Rename moves a file within its storage. Between storages, files are copied then deleted
+// if MountSettings.CopyAcrossMounts is set.
+func (t *MountTable) Rename(from string, to string) error {
+	if t.fixed(from) || t.fixed(to) {
+		return &os.LinkError{Op: "rename", Old: from, New: to, Err: errMountPoint}
+	}
+	fromMount, fromPath, fromOk := t.resolve(from)
+	toMount, toPath, toOk := t.resolve(to)
+	if !fromOk || !toOk {
+		return &os.LinkError{Op: "rename", Old: from, New: to, Err: os.ErrNotExist}
+	}
+	if fromMount == toMount {
+		return fromMount.Storage.Rename(fromPath, toPath)
+	}
+	if !t.settings.CopyAcrossMounts {
+		return &os.LinkError{Op: "rename", Old: from, New: to, Err: ErrCrossMount}
+	}
+	_, err := t.Stat(to)
+	existed := err == nil
+	if err := t.copy(from, to); err != nil {
+		// Leave no partial copy behind, but never a destination that was there before
+		if !existed {
+			t.removeAll(to)
+		}
+		return err
+	}
+	return t.removeAll(from)
+}
+
+func (t *MountTable) Mkdir(dirPath string) error {
+	mount, storagePath, ok := t.resolve(dirPath)
+	if !ok {
+		return &os.PathError{Op: "mkdir", Path: dirPath, Err: os.ErrNotExist}
+	}
+	return mount.Storage.Mkdir(storagePath)
+}
+
+func (t *MountTable) Chtimes(filePath string, modTime time.Time) error {
+	mount, storagePath, ok := t.resolve(filePath)
+	if !ok {
+		return &os.PathError{Op: "chtimes", Path: filePath, Err: os.ErrNotExist}
+	}
+	return mount.Storage.Chtimes(storagePath, modTime)
+}
+
+func (t *MountTable) SetCreationTime(filePath string, creationTime time.Time) error {
+	mount, storagePath, ok := t.resolve(filePath)
+	if !ok {
+		return &os.PathError{Op: "setcreationtime", Path: filePath, Err: os.ErrNotExist}
+	}
+	storage, ok := mount.Storage.(CreationTimeStorage)
+	if !ok {
+		return errors.New("storage does not support creation times")
+	}
+	return storage.SetCreationTime(storagePath, creationTime)
+}
+
+func (t *MountTable) SetXattr(filePath string, name string, value []byte) error {
+	mount, storagePath, ok := t.resolve(filePath)
+	if !ok {
+		return &os.PathError{Op: "setxattr", Path: filePath, Err: os.ErrNotExist}
+	}
+	storage, ok := mount.Storage.(XattrStorage)
+	if !ok {
+		return errors.New("storage does not support extended attributes")
+	}
+	return storage.SetXattr(storagePath, name, value)
+}
+
+// ReadOnly reports paths of read-only storages, and directories leading to mount points
+// that no storage holds, as read-only
+func (t *MountTable) ReadOnly(filePath string) bool {
+	mount, storagePath, ok := t.resolve(filePath)
+	if !ok {
+		return true
+	}
+	storage, ok := mount.Storage.(ReadOnlyStorage)
+	return ok && storage.ReadOnly(storagePath)
+}
+
+// Unwrap returns the storage of the mount serving a path
+func (t *MountTable) Unwrap(filePath string) (Storage, string) {
+	mount, storagePath, ok := t.resolve(filePath)
+	if !ok {
+		return nil, ""
+	}
+	return mount.Storage, storagePath
+}
+
+// encrypted returns a MountTable of the same mounts with the storage of each wrapped in an
+// EncryptedStorage, except read-only storages, which cannot hold encrypted files
+func (t *MountTable) encrypted(key []byte) (*MountTable, error) {
+	encrypted := &MountTable{settings: t.settings}
+	for _, mount := range t.mounts {
+		if readOnly, ok := mount.Storage.(ReadOnlyStorage); !ok || !readOnly.ReadOnly(mount.Root) {
+			storage, err := NewEncryptedStorage(mount.Storage, key)
+			if err != nil {
+				return nil, err
+			}
+			mount.Storage = storage
+		}
+		encrypted.mounts = append(encrypted.mounts, mount)
+	}
+	return encrypted, nil
+}
+
+// copy copies a file or a directory tree, keeping modification times where the
+// destination allows it
+func (t *MountTable) copy(from string, to string) error {
+	info, err := t.Stat(from)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		if err := t.Mkdir(to); err != nil {
+			return err
+		}
+		infos, err := t.ReadDir(from)
+		if err != nil {
+			return err
+		}
+		for _, entry := range infos {
+			if err := t.copy(path.Join(from, entry.Name()), path.Join(to, entry.Name())); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	src, err := t.Open(from, 0)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := t.Create(to, 0)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		abortWrite(dst)
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+	t.Chtimes(to, info.ModTime())
+	return nil
+}
+
+// removeAll removes a file or a directory tree
+func (t *MountTable) removeAll(filePath string) error {
+	info, err := t.Stat(filePath)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		infos, err := t.ReadDir(filePath)
+		if err != nil {
+			return err
+		}
+		for _, entry := range infos {
+			if err := t.removeAll(path.Join(filePath, entry.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return t.Remove(filePath)
+}
+
+// mountInfo describes a mount point under its name in the tree, or a directory leading to
+// mount points if FileInfo is nil
+type mountInfo struct {
+	os.FileInfo
+	name string
+}
+
+func (mi *mountInfo) Name() string { return mi.name }
+func (mi *mountInfo) Size() int64 {
+	if mi.FileInfo == nil {
+		return 0
+	}
+	return mi.FileInfo.Size()
+}
+func (mi *mountInfo) Mode() os.FileMode {
+	if mi.FileInfo == nil {
+		return os.ModeDir | 0555
+	}
+	return mi.FileInfo.Mode()
+}
+func (mi *mountInfo) ModTime() time.Time {
+	if mi.FileInfo == nil {
+		return time.Time{}
+	}
+	return mi.FileInfo.ModTime()
+}
+func (mi *mountInfo) IsDir() bool {
+	return mi.FileInfo == nil || mi.FileInfo.IsDir()
+}
+func (mi *mountInfo) Sys() interface{} {
+	if mi.FileInfo == nil {
+		return nil
+	}
+	return mi.FileInfo.Sys()
+}
@@ -0,0 +1,251 @@
+package server
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/Charana123/ftp/server/memfs"
+)
+
+var _ Storage = (*MountTable)(nil)
+
+func TestMountResolve(t *testing.T) {
+	root, archive, old, docs := memfs.New(), memfs.New(), memfs.New(), memfs.New()
+	mounts := []Mount{
+		{Path: "/srv/ftp/archive", Storage: archive, Root: "/archive"},
+		{Path: "/", Storage: root},
+		{Path: "docs/", Storage: docs},
+		{Path: "/srv/ftp/archive/old", Storage: old},
+	}
+	for _, test := range []struct {
+		path        string
+		storage     Storage
+		storagePath string
+	}{
+		{"/", root, "/"},
+		{"/srv/ftp", root, "/srv/ftp"},
+		{"/srv/ftp/archive", archive, "/archive"},
+		{"/srv/ftp/archive/2020/a.txt", archive, "/archive/2020/a.txt"},
+		{"/srv/ftp/archived", root, "/srv/ftp/archived"},
+		{"/srv/ftp/archive/old", old, "/"},
+		{"/srv/ftp/archive/old/b.txt", old, "/b.txt"},
+		{"/srv/ftp/archive/older", archive, "/archive/older"},
+		{"srv/../docs//c.txt", docs, "/c.txt"},
+	} {
+		mount, storagePath, ok := NewMountTable(mounts, MountSettings{}).resolve(test.path)
+		if !ok || mount.Storage != test.storage || storagePath != test.storagePath {
+			t.Errorf("resolve(%s) = %v, %q, %v, want %q", test.path, mount, storagePath, ok, test.storagePath)
+		}
+	}
+
+	// Without a "/" mount, only paths under mount points resolve
+	table := NewMountTable(mounts[2:], MountSettings{})
+	for _, filePath := range []string{"/", "/srv", "/srv/ftp/archive", "/documents"} {
+		if mount, _, ok := table.resolve(filePath); ok {
+			t.Errorf("resolve(%s) = %v", filePath, mount.Path)
+		}
+	}
+}
+
+func TestMountedBelow(t *testing.T) {
+	mounts := []Mount{
+		{Path: "/srv/ftp/archive", Storage: memfs.New()},
+		{Path: "/srv/ftp/archive/old", Storage: memfs.New()},
+		{Path: "/srv/ftp/incoming", Storage: memfs.New()},
+		{Path: "/srv/docs", Storage: memfs.New()},
+	}
+	for _, root := range []bool{false, true} {
+		if root {
+			mounts = append(mounts, Mount{Path: "/", Storage: memfs.New()})
+		}
+		table := NewMountTable(mounts, MountSettings{})
+		for _, test := range []struct {
+			dirPath string
+			names   []string
+			fixed   bool
+		}{
+			{"/", []string{"srv"}, true},
+			{"/srv", []string{"docs", "ftp"}, true},
+			{"/srv/ftp/", []string{"archive", "incoming"}, true},
+			{"/srv/ftp/archive", []string{"old"}, true},
+			{"/srv/ftp/archive/old", []string{}, true},
+			{"/srv/ftp/archive/2020", []string{}, false},
+			{"/srv/ft", []string{}, false},
+			{"/elsewhere", []string{}, false},
+		} {
+			names := table.mountedBelow(test.dirPath)
+			sort.Strings(names)
+			if !reflect.DeepEqual(names, test.names) {
+				t.Errorf("root mounted %v: mountedBelow(%s) = %v, want %v", root, test.dirPath, names, test.names)
+			}
+			if fixed := table.fixed(test.dirPath); fixed != test.fixed {
+				t.Errorf("root mounted %v: fixed(%s) = %v, want %v", root, test.dirPath, fixed, test.fixed)
+			}
+		}
+	}
+}
+
+// readDirNames returns the names of the entries of a directory, "/" marking directories
+func readDirNames(t *testing.T, table *MountTable, dirPath string) []string {
+	t.Helper()
+	infos, err := table.ReadDir(dirPath)
+	if err != nil {
+		t.Fatalf("ReadDir(%s): %v", dirPath, err)
+	}
+	names := []string{}
+	for _, info := range infos {
+		name := info.Name()
+		if info.IsDir() {
+			name += "/"
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+func TestMountDirectories(t *testing.T) {
+	root, archive, incoming := memfs.New(), memfs.New(), memfs.New()
+	root.WriteFile("/srv/ftp/notes.txt", []byte("notes"), 0644)
+	root.WriteFile("/srv/ftp/archive/hidden.txt", []byte("hidden by the mount"), 0644)
+	archive.WriteFile("/a.txt", []byte("a"), 0644)
+	incoming.WriteFile("/in/b.txt", []byte("bb"), 0644)
+	mounts := []Mount{
+		{Path: "/srv/ftp/archive", Storage: archive},
+		{Path: "/srv/ftp/incoming", Storage: incoming, Root: "/in"},
+	}
+
+	// Intermediate directories exist for the mount points below them
+	table := NewMountTable(mounts, MountSettings{})
+	for _, test := range []struct {
+		dirPath string
+		names   []string
+	}{
+		{"/", []string{"srv/"}},
+		{"/srv", []string{"ftp/"}},
+		{"/srv/ftp", []string{"archive/", "incoming/"}},
+		{"/srv/ftp/incoming", []string{"b.txt"}},
+	} {
+		if names := readDirNames(t, table, test.dirPath); !reflect.DeepEqual(names, test.names) {
+			t.Errorf("ReadDir(%s) = %v, want %v", test.dirPath, names, test.names)
+		}
+	}
+	for filePath, name := range map[string]string{"/": "/", "/srv": "srv", "/srv/ftp": "ftp", "/srv/ftp/incoming": "incoming"} {
+		if info, err := table.Stat(filePath); err != nil || !info.IsDir() || info.Name() != name {
+			t.Errorf("Stat(%s) = %v, %v", filePath, info, err)
+		}
+	}
+	if info, err := table.Stat("/srv/ftp/incoming/b.txt"); err != nil || info.Size() != 2 {
+		t.Errorf("Stat(b.txt) = %v, %v", info, err)
+	}
+	for _, filePath := range []string{"/srv/ftp/notes.txt", "/srv/other", "/other"} {
+		if _, err := table.Stat(filePath); !os.IsNotExist(err) {
+			t.Errorf("Stat(%s) = %v", filePath, err)
+		}
+	}
+	if _, err := table.ReadDir("/srv/other"); !os.IsNotExist(err) {
+		t.Errorf("ReadDir(/srv/other) = %v", err)
+	}
+
+	// Mount points join the entries of the storage mounted above them, hiding the
+	// entries of the same name
+	table = NewMountTable(append(mounts, Mount{Path: "/", Storage: root}), MountSettings{})
+	if names, want := readDirNames(t, table, "/srv/ftp"), []string{"archive/", "incoming/", "notes.txt"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("ReadDir(/srv/ftp) = %v, want %v", names, want)
+	}
+	if names, want := readDirNames(t, table, "/srv/ftp/archive"), []string{"a.txt"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("ReadDir(/srv/ftp/archive) = %v, want %v", names, want)
+	}
+	if err := table.Remove("/srv/ftp"); !errors.Is(err, errMountPoint) {
+		t.Errorf("Remove(/srv/ftp) = %v", err)
+	}
+	if err := table.Remove("/srv/ftp/notes.txt"); err != nil {
+		t.Errorf("Remove(notes.txt) = %v", err)
+	}
+}
+
+func TestMountRename(t *testing.T) {
+	modTime := time.Date(2020, 3, 2, 10, 0, 0, 0, time.UTC)
+	newTable := func(settings MountSettings) (*MountTable, *memfs.FS, *memfs.FS) {
+		archive, incoming := memfs.New(), memfs.New()
+		incoming.WriteFile("/batch/a.txt", []byte("a"), 0644)
+		incoming.WriteFile("/batch/sub/b.txt", []byte("bb"), 0644)
+		incoming.Chtimes("/batch/a.txt", modTime)
+		table := NewMountTable([]Mount{
+			{Path: "/archive", Storage: archive},
+			{Path: "/incoming", Storage: incoming},
+		}, settings)
+		return table, archive, incoming
+	}
+
+	table, _, incoming := newTable(MountSettings{})
+	if err := table.Rename("/incoming/batch", "/archive/batch"); !errors.Is(err, ErrCrossMount) {
+		t.Errorf("Rename across mounts = %v, want ErrCrossMount", err)
+	}
+	if err := table.Rename("/incoming/batch/a.txt", "/incoming/a.txt"); err != nil {
+		t.Errorf("Rename within a mount = %v", err)
+	}
+	if _, err := incoming.Stat("/a.txt"); err != nil {
+		t.Errorf("renamed file: %v", err)
+	}
+	for _, test := range [][2]string{{"/incoming", "/inbox"}, {"/", "/x"}, {"/incoming/a.txt", "/archive"}} {
+		if err := table.Rename(test[0], test[1]); !errors.Is(err, errMountPoint) {
+			t.Errorf("Rename(%s, %s) = %v", test[0], test[1], err)
+		}
+	}
+
+	// Copied then deleted
+	table, archive, incoming := newTable(MountSettings{CopyAcrossMounts: true})
+	if err := table.Rename("/incoming/batch", "/archive/2020"); err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range map[string]string{"/2020/a.txt": "a", "/2020/sub/b.txt": "bb"} {
+		r, err := archive.Open(name, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, _ := ioutil.ReadAll(r)
+		r.Close()
+		if string(got) != data {
+			t.Errorf("%s = %q, want %q", name, got, data)
+		}
+	}
+	if info, err := archive.Stat("/2020/a.txt"); err != nil || !info.ModTime().Equal(modTime) {
+		t.Errorf("copied file = %v, %v, want the modification time kept", info, err)
+	}
+	if _, err := incoming.Stat("/batch"); !os.IsNotExist(err) {
+		t.Errorf("Stat of the moved directory = %v", err)
+	}
+
+	// A copy failing halfway is removed, leaving the source untouched
+	table, archive, incoming = newTable(MountSettings{CopyAcrossMounts: true})
+	injected := errors.New("injected")
+	archive.SetFaults(memfs.Faults{Fail: func(op memfs.Op, name string) error {
+		if op == memfs.OpWrite && name == "/2020/sub/b.txt" {
+			return injected
+		}
+		return nil
+	}})
+	if err := table.Rename("/incoming/batch", "/archive/2020"); !errors.Is(err, injected) {
+		t.Errorf("failing Rename = %v", err)
+	}
+	if _, err := archive.Stat("/2020"); !os.IsNotExist(err) {
+		t.Errorf("Stat of the partial copy = %v", err)
+	}
+	if _, err := incoming.Stat("/batch/sub/b.txt"); err != nil {
+		t.Errorf("Stat of the source = %v", err)
+	}
+	// Destinations that existed before the copy are kept
+	archive.SetFaults(memfs.Faults{})
+	archive.WriteFile("/existing/kept.txt", []byte("kept"), 0644)
+	if err := table.Rename("/incoming/batch", "/archive/existing"); err == nil {
+		t.Error("Rename onto an existing directory succeeded")
+	}
+	if _, err := archive.Stat("/existing/kept.txt"); err != nil {
+		t.Errorf("Stat of the existing destination = %v", err)
+	}
+}
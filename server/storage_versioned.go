@@ -0,0 +1,415 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// versionsDirectory holds the previous contents of overwritten files, in each directory
+	versionsDirectory = ".versions"
+	// trashDirectory holds deleted files, in each directory
+	trashDirectory = ".trash"
+	// versionStampFormat timestamps the versions of a file, in UTC
+	versionStampFormat = "20060102150405.000000000"
+)
+
+// VersioningSettings configures the retention of a VersionedStorage
+type VersioningSettings struct {
+	// Versions kept of each file, and deleted copies kept of each name, all if zero
+	MaxVersions int
+	// Age after which versions and deleted files are purged, never if zero
+	MaxAge time.Duration
+}
+
+// FileVersion is a previous or deleted copy of a file kept by a VersionedStorage
+type FileVersion struct {
+	ID      string    // Timestamp identifying the version, given to SITE RESTORE
+	Time    time.Time // When the file was overwritten or deleted
+	Size    int64
+	Deleted bool // Whether the file was deleted rather than overwritten
+}
+
+// VersionedStorage wraps a Storage to keep the previous contents of files. Files overwritten
+// by an upload or a rename move to a hidden .versions directory and deleted files to a
+// hidden .trash directory, next to the file and under a timestamped name, from which they
+// can be listed and restored with SITE VERSIONS, SITE TRASH and SITE RESTORE. These
+// directories cannot be accessed directly. Uploads replacing a file are written aside and
+// only replace it once complete, while resumed uploads (REST) modify the file in place.
+type VersionedStorage struct {
+	Storage
+	settings VersioningSettings
+	lock     sync.Mutex
+}
+
+// NewVersionedStorage creates a VersionedStorage keeping versions of the files of `storage`
+func NewVersionedStorage(storage Storage, settings VersioningSettings) *VersionedStorage {
+	return &VersionedStorage{Storage: storage, settings: settings}
+}
+
+func (v *VersionedStorage) Stat(filePath string) (os.FileInfo, error) {
+	if inVersionArea(filePath) {
+		return nil, &os.PathError{Op: "stat", Path: filePath, Err: os.ErrPermission}
+	}
+	return v.Storage.Stat(filePath)
+}
+
+// ReadDir hides the directories holding versions and deleted files
+func (v *VersionedStorage) ReadDir(dirPath string) ([]os.FileInfo, error) {
+	if inVersionArea(dirPath) {
+		return nil, &os.PathError{Op: "readdir", Path: dirPath, Err: os.ErrPermission}
+	}
+	infos, err := v.Storage.ReadDir(dirPath)
+	if err != nil {
+		return nil, err
+	}
+	visible := make([]os.FileInfo, 0, len(infos))
+	for _, info := range infos {
+		if info.IsDir() && (info.Name() == versionsDirectory || info.Name() == trashDirectory) {
+			continue
+		}
+		visible = append(visible, info)
+	}
+	return visible, nil
+}
+
+func (v *VersionedStorage) Open(filePath string, offset int64) (io.ReadCloser, error) {
+	if inVersionArea(filePath) {
+		return nil, &os.PathError{Op: "open", Path: filePath, Err: os.ErrPermission}
+	}
+	return v.Storage.Open(filePath, offset)
+}
+
+// Create writes a file replacing an existing one under a temporary name in the .versions
+// directory, keeping the existing file as a version and moving the new one in its place
+// once closed. Resumed uploads start from a copy of the first `offset` bytes of the file.
+func (v *VersionedStorage) Create(filePath string, offset int64) (io.WriteCloser, error) {
+	if inVersionArea(filePath) {
+		return nil, &os.PathError{Op: "create", Path: filePath, Err: os.ErrPermission}
+	}
+	info, err := v.Storage.Stat(filePath)
+	if os.IsNotExist(err) || (err == nil && info.IsDir()) {
+		return v.Storage.Create(filePath, offset)
+	} else if err != nil {
+		return nil, err
+	}
+	dir, name := path.Split(filePath)
+	areaPath, err := v.area(dir, versionsDirectory)
+	if err != nil {
+		return nil, err
+	}
+	uploadPath := path.Join(areaPath, name+"."+time.Now().UTC().Format(versionStampFormat)+".upload")
+	file, err := v.Storage.Create(uploadPath, 0)
+	if err != nil {
+		return nil, err
+	}
+	if offset > 0 {
+		if err := v.copyPrefix(filePath, offset, file); err != nil {
+			abortWrite(file)
+			v.Storage.Remove(uploadPath)
+			return nil, err
+		}
+	}
+	return &versionedWriter{WriteCloser: file, storage: v, filePath: filePath, uploadPath: uploadPath}, nil
+}
+
+func (v *VersionedStorage) Remove(filePath string) error {
+	if inVersionArea(filePath) {
+		return &os.PathError{Op: "remove", Path: filePath, Err: os.ErrPermission}
+	}
+	info, err := v.Storage.Stat(filePath)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return v.Storage.Remove(filePath)
+	}
+	return v.keep(filePath, trashDirectory)
+}
+
+func (v *VersionedStorage) Rename(from string, to string) error {
+	if inVersionArea(from) || inVersionArea(to) {
+		return &os.LinkError{Op: "rename", Old: from, New: to, Err: os.ErrPermission}
+	}
+	if err := v.keep(to, versionsDirectory); err != nil {
+		return err
+	}
+	return v.Storage.Rename(from, to)
+}
+
+func (v *VersionedStorage) Mkdir(dirPath string) error {
+	if inVersionArea(dirPath) {
+		return &os.PathError{Op: "mkdir", Path: dirPath, Err: os.ErrPermission}
+	}
+	return v.Storage.Mkdir(dirPath)
+}
+
+func (v *VersionedStorage) Chtimes(filePath string, modTime time.Time) error {
+	if inVersionArea(filePath) {
+		return &os.PathError{Op: "chtimes", Path: filePath, Err: os.ErrPermission}
+	}
+	return v.Storage.Chtimes(filePath, modTime)
+}
+
+func (v *VersionedStorage) SetCreationTime(filePath string, creationTime time.Time) error {
+	if inVersionArea(filePath) {
+		return &os.PathError{Op: "setcreationtime", Path: filePath, Err: os.ErrPermission}
+	}
+	storage, ok := v.Storage.(CreationTimeStorage)
+	if !ok {
+		return errors.New("storage does not support creation times")
+	}
+	return storage.SetCreationTime(filePath, creationTime)
+}
+
+func (v *VersionedStorage) SetXattr(filePath string, name string, value []byte) error {
+	if inVersionArea(filePath) {
+		return &os.PathError{Op: "setxattr", Path: filePath, Err: os.ErrPermission}
+	}
+	storage, ok := v.Storage.(XattrStorage)
+	if !ok {
+		return errors.New("storage does not support extended attributes")
+	}
+	return storage.SetXattr(filePath, name, value)
+}
+
+// Unwrap returns the wrapped storage
+func (v *VersionedStorage) Unwrap(filePath string) (Storage, string) {
+	return v.Storage, filePath
+}
+
+// Versions returns the previous and deleted copies of a file, newest first
+func (v *VersionedStorage) Versions(filePath string) ([]FileVersion, error) {
+	if inVersionArea(filePath) {
+		return nil, &os.PathError{Op: "versions", Path: filePath, Err: os.ErrPermission}
+	}
+	dir, name := path.Split(filePath)
+	versions := []FileVersion{}
+	for _, area := range []string{versionsDirectory, trashDirectory} {
+		areaVersions, err := v.areaVersions(path.Join(dir, area), name)
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, areaVersions...)
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i].Time.After(versions[j].Time) })
+	return versions, nil
+}
+
+// Trash returns the names of the deleted files of a directory
+func (v *VersionedStorage) Trash(dirPath string) ([]string, error) {
+	if inVersionArea(dirPath) {
+		return nil, &os.PathError{Op: "trash", Path: dirPath, Err: os.ErrPermission}
+	}
+	infos, err := v.Storage.ReadDir(path.Join(dirPath, trashDirectory))
+	if os.IsNotExist(err) {
+		return []string{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	names := []string{}
+	for _, info := range infos {
+		if name, _, ok := parseVersionName(info.Name()); ok && !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// Restore brings back a version of a file, keeping the current contents as a new version
+func (v *VersionedStorage) Restore(filePath string, id string) error {
+	if _, err := time.Parse(versionStampFormat, id); err != nil || inVersionArea(filePath) {
+		return os.ErrNotExist
+	}
+	dir, name := path.Split(filePath)
+	for _, area := range []string{versionsDirectory, trashDirectory} {
+		versionPath := path.Join(dir, area, name+"."+id)
+		if _, err := v.Storage.Stat(versionPath); err != nil {
+			continue
+		}
+		// Set aside under a name retention ignores, as keeping the current contents may
+		// prune the version being restored
+		restoringPath := versionPath + ".restoring"
+		if err := v.Storage.Rename(versionPath, restoringPath); err != nil {
+			return err
+		}
+		if err := v.keep(filePath, versionsDirectory); err != nil {
+			v.Storage.Rename(restoringPath, versionPath)
+			return err
+		}
+		return v.Storage.Rename(restoringPath, filePath)
+	}
+	return os.ErrNotExist
+}
+
+// keep moves an existing file to the `area` directory next to it under a timestamped name,
+// then applies the retention settings
+func (v *VersionedStorage) keep(filePath string, area string) error {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	info, err := v.Storage.Stat(filePath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return nil
+	}
+	dir, name := path.Split(filePath)
+	areaPath, err := v.area(dir, area)
+	if err != nil {
+		return err
+	}
+	stamp := time.Now().UTC().Format(versionStampFormat)
+	if err := v.Storage.Rename(filePath, path.Join(areaPath, name+"."+stamp)); err != nil {
+		return err
+	}
+	// Retention is best effort, the file has been kept either way
+	if err := v.prune(areaPath, name); err != nil {
+		log.Println("Failed to prune " + areaPath + ": " + err.Error())
+	}
+	return nil
+}
+
+// area returns the path of the `area` directory of a directory, creating it if needed
+func (v *VersionedStorage) area(dirPath string, area string) (string, error) {
+	areaPath := path.Join(dirPath, area)
+	if _, err := v.Storage.Stat(areaPath); os.IsNotExist(err) {
+		if err := v.Storage.Mkdir(areaPath); err != nil {
+			if _, statErr := v.Storage.Stat(areaPath); statErr != nil {
+				return "", err
+			}
+		}
+	}
+	return areaPath, nil
+}
+
+// prune removes the copies of `name` beyond the number kept, and any copy in the area
+// older than the maximum age
+func (v *VersionedStorage) prune(areaPath string, name string) error {
+	infos, err := v.Storage.ReadDir(areaPath)
+	if err != nil {
+		return err
+	}
+	kept := 0
+	// Names end with a timestamp, so the newest copies of a file come last
+	for i := len(infos) - 1; i >= 0; i-- {
+		versionName, stamp, ok := parseVersionName(infos[i].Name())
+		if !ok {
+			continue
+		}
+		expired := v.settings.MaxAge > 0 && time.Since(stamp) > v.settings.MaxAge
+		if versionName == name {
+			kept++
+			expired = expired || (v.settings.MaxVersions > 0 && kept > v.settings.MaxVersions)
+		}
+		if expired {
+			if err := v.Storage.Remove(path.Join(areaPath, infos[i].Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// areaVersions returns the copies of `name` kept in the `areaPath` directory
+func (v *VersionedStorage) areaVersions(areaPath string, name string) ([]FileVersion, error) {
+	infos, err := v.Storage.ReadDir(areaPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	versions := []FileVersion{}
+	for _, info := range infos {
+		versionName, stamp, ok := parseVersionName(info.Name())
+		if !ok || versionName != name {
+			continue
+		}
+		versions = append(versions, FileVersion{
+			ID:      strings.TrimPrefix(info.Name(), name+"."),
+			Time:    stamp,
+			Size:    info.Size(),
+			Deleted: path.Base(areaPath) == trashDirectory,
+		})
+	}
+	return versions, nil
+}
+
+// parseVersionName splits the name of a kept copy into the name of the file and the time
+// it was kept
+func parseVersionName(versionName string) (string, time.Time, bool) {
+	if len(versionName) < len(versionStampFormat)+2 {
+		return "", time.Time{}, false
+	}
+	split := len(versionName) - len(versionStampFormat)
+	if versionName[split-1] != '.' {
+		return "", time.Time{}, false
+	}
+	stamp, err := time.ParseInLocation(versionStampFormat, versionName[split:], time.UTC)
+	if err != nil {
+		return "", time.Time{}, false
+	}
+	return versionName[:split-1], stamp, true
+}
+
+// inVersionArea reports whether a path is, or lies in, a directory holding versions or
+// deleted files
+func inVersionArea(filePath string) bool {
+	for _, element := range strings.Split(path.Clean("/"+filePath), "/") {
+		if element == versionsDirectory || element == trashDirectory {
+			return true
+		}
+	}
+	return false
+}
+
+// copyPrefix copies the first `size` bytes of a file
+func (v *VersionedStorage) copyPrefix(filePath string, size int64, dst io.Writer) error {
+	file, err := v.Storage.Open(filePath, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = io.CopyN(dst, file, size)
+	return err
+}
+
+// versionedWriter writes a file replacing another under a temporary name
+type versionedWriter struct {
+	io.WriteCloser
+	storage    *VersionedStorage
+	filePath   string
+	uploadPath string
+}
+
+// Close keeps the file being replaced as a version, then moves the new file in its place
+func (w *versionedWriter) Close() error {
+	err := w.WriteCloser.Close()
+	if err == nil {
+		err = w.storage.keep(w.filePath, versionsDirectory)
+	}
+	if err == nil {
+		err = w.storage.Storage.Rename(w.uploadPath, w.filePath)
+	}
+	if err != nil {
+		w.storage.Storage.Remove(w.uploadPath)
+	}
+	return err
+}
+
+// Abort discards the new file, leaving the file it was to replace untouched
+func (w *versionedWriter) Abort() error {
+	abortWrite(w.WriteCloser)
+	return w.storage.Storage.Remove(w.uploadPath)
+}
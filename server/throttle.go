@@ -0,0 +1,232 @@
+package server
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// throttleChunkSize is the largest number of bytes a transfer moves per token request.
+// Keeping chunks small interleaves concurrent transfers sharing a bucket fairly.
+const throttleChunkSize = 32 * 1024
+
+var (
+	// globalUploadBucket limits the combined upload throughput of all connections
+	globalUploadBucket = newTokenBucket(0)
+	// globalDownloadBucket limits the combined download throughput of all connections
+	globalDownloadBucket = newTokenBucket(0)
+	// userBucketsLock synchronises access to userBuckets
+	userBucketsLock = &sync.Mutex{}
+	// userBuckets holds the buckets shared by all connections of the same user
+	userBuckets = make(map[string]*bucketPair)
+)
+
+// RateLimits caps transfer throughput in bytes per second.
+// A zero (or negative) value leaves that direction unlimited.
+type RateLimits struct {
+	Upload   int64
+	Download int64
+}
+
+// bucketPair holds one token bucket per transfer direction
+type bucketPair struct {
+	upload   *tokenBucket
+	download *tokenBucket
+}
+
+func newBucketPair(limits RateLimits) *bucketPair {
+	return &bucketPair{
+		upload:   newTokenBucket(limits.Upload),
+		download: newTokenBucket(limits.Download),
+	}
+}
+
+func (p *bucketPair) setLimits(limits RateLimits) {
+	p.upload.setRate(limits.Upload)
+	p.download.setRate(limits.Download)
+}
+
+// tokenBucket is a token bucket rate limiter refilled at `rate` bytes per second.
+// Reservations may drive the bucket negative, in which case callers wait in the order
+// they reserved, which shares the available bandwidth fairly between transfers.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   int64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate int64) *tokenBucket {
+	return &tokenBucket{
+		rate:   rate,
+		tokens: float64(rate),
+		last:   time.Now(),
+	}
+}
+
+// setRate changes the refill rate of the bucket, taking effect on the next reservation
+func (b *tokenBucket) setRate(rate int64) {
+	b.mu.Lock()
+	b.refill(time.Now())
+	b.rate = rate
+	if b.tokens > float64(rate) {
+		b.tokens = float64(rate)
+	}
+	b.mu.Unlock()
+}
+
+// refill adds the tokens accumulated since the last refill, capped at one second's worth
+func (b *tokenBucket) refill(now time.Time) {
+	if b.rate > 0 {
+		b.tokens += now.Sub(b.last).Seconds() * float64(b.rate)
+		if b.tokens > float64(b.rate) {
+			b.tokens = float64(b.rate)
+		}
+	}
+	b.last = now
+}
+
+// reserve takes `n` tokens from the bucket and returns how long the caller must wait
+// before using them
+func (b *tokenBucket) reserve(n int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.rate <= 0 {
+		return 0
+	}
+	b.refill(time.Now())
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / float64(b.rate) * float64(time.Second))
+}
+
+// waitBuckets reserves `n` tokens from every bucket and blocks until all of them allow it
+func waitBuckets(buckets []*tokenBucket, n int) {
+	var delay time.Duration
+	for _, b := range buckets {
+		if d := b.reserve(n); d > delay {
+			delay = d
+		}
+	}
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+// throttledReader rate limits reads from an underlying reader
+type throttledReader struct {
+	r       io.Reader
+	buckets []*tokenBucket
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > throttleChunkSize {
+		p = p[:throttleChunkSize]
+	}
+	n, err := t.r.Read(p)
+	if n > 0 {
+		waitBuckets(t.buckets, n)
+	}
+	return n, err
+}
+
+// throttledWriter rate limits writes to an underlying writer
+type throttledWriter struct {
+	w       io.Writer
+	buckets []*tokenBucket
+}
+
+func (t *throttledWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > throttleChunkSize {
+			chunk = chunk[:throttleChunkSize]
+		}
+		waitBuckets(t.buckets, len(chunk))
+		n, err := t.w.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// getUserBuckets returns the buckets shared by every connection of `user`
+func getUserBuckets(user string) *bucketPair {
+	userBucketsLock.Lock()
+	defer userBucketsLock.Unlock()
+	pair, ok := userBuckets[user]
+	if !ok {
+		pair = newBucketPair(RateLimits{})
+		userBuckets[user] = pair
+	}
+	return pair
+}
+
+// SetGlobalRateLimits changes the throughput shared by all connections at runtime
+func SetGlobalRateLimits(limits RateLimits) {
+	globalUploadBucket.setRate(limits.Upload)
+	globalDownloadBucket.setRate(limits.Download)
+}
+
+// SetUserRateLimits changes the throughput shared by all connections of `user` at runtime
+func SetUserRateLimits(user string, limits RateLimits) {
+	getUserBuckets(user).setLimits(limits)
+}
+
+// SetRateLimits changes the throughput of this connection alone at runtime
+func (ctx *UserContext) SetRateLimits(limits RateLimits) {
+	ctx.sessionBuckets.setLimits(limits)
+}
+
+// applyUserRateLimits asks the driver, if it supports it, for the rate limits of the
+// user that just logged in
+func (conn *ftpConnection) applyUserRateLimits() error {
+	rateLimitDriver, ok := globalDriver.(RateLimitDriver)
+	if !ok {
+		return nil
+	}
+	limits, err := rateLimitDriver.GetUserRateLimits(conn.ctx)
+	if err != nil {
+		return err
+	}
+	SetUserRateLimits(conn.loginUser, limits)
+	return nil
+}
+
+// transferBuckets returns every bucket applying to a transfer in the given direction
+func (conn *ftpConnection) transferBuckets(upload bool) []*tokenBucket {
+	buckets := make([]*tokenBucket, 0, 3)
+	session := conn.ctx.sessionBuckets
+	var user *bucketPair
+	if conn.loginUser != "" {
+		user = getUserBuckets(conn.loginUser)
+	}
+	if upload {
+		buckets = append(buckets, session.upload, globalUploadBucket)
+		if user != nil {
+			buckets = append(buckets, user.upload)
+		}
+	} else {
+		buckets = append(buckets, session.download, globalDownloadBucket)
+		if user != nil {
+			buckets = append(buckets, user.download)
+		}
+	}
+	return buckets
+}
+
+// uploadReader wraps the data connection with the upload rate limits of this connection
+func (conn *ftpConnection) uploadReader(r io.Reader) io.Reader {
+	return &throttledReader{r: r, buckets: conn.transferBuckets(true)}
+}
+
+// downloadWriter wraps the data connection with the download rate limits of this connection
+func (conn *ftpConnection) downloadWriter(w io.Writer) io.Writer {
+	return &throttledWriter{w: w, buckets: conn.transferBuckets(false)}
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"compress/zlib"
+	"io"
+	"strconv"
+)
+
+// transferWriter wraps the data connection for sending according to the negotiated
+// transfer parameters: ASCII conversion and restart markers (for files sent from `offset`
+// rather than listings), MODE Z compression or MODE B framing and rate limits. `finish`
+// flushes any buffered data and must be called before closing the data connection.
+func (conn *ftpConnection) transferWriter(isFile bool, offset int64) (w io.Writer, finish func() error) {
+	w = conn.downloadWriter(conn.data)
+	finish = func() error { return nil }
+	var blocks *blockWriter
+	switch conn.ctx.TransferMode {
+	case "B":
+		blocks = &blockWriter{w: w}
+		w, finish = blocks, blocks.Close
+	case "Z":
+		zw, err := zlib.NewWriterLevel(w, conn.modeZLevel())
+		if err != nil {
+			zw = zlib.NewWriter(w)
+		}
+		w, finish = zw, zw.Close
+	}
+	if isFile && conn.ctx.TransferType == "A" {
+		w = &asciiWriter{w: w}
+	}
+	// Restart markers hold offsets in the stored file, before any ASCII conversion
+	if isFile && blocks != nil {
+		w = &markerWriter{w: w, blocks: blocks, offset: offset, interval: blockRestartInterval()}
+	}
+	return w, finish
+}
+
+// transferReader wraps the data connection for receiving a file stored from `offset`
+// according to the negotiated transfer parameters: rate limits, MODE Z decompression or
+// MODE B framing and ASCII conversion
+func (conn *ftpConnection) transferReader(offset int64) (io.Reader, error) {
+	r := conn.uploadReader(conn.data)
+	switch conn.ctx.TransferMode {
+	case "B":
+		r = &blockReader{r: r, offset: offset, ascii: conn.ctx.TransferType == "A", onMarker: func(marker string, offset int64) {
+			// Tells the user the server marker to give to REST to resume from this point
+			conn.sendReply(110, "MARK "+marker+" = "+strconv.FormatInt(offset, 10))
+		}}
+	case "Z":
+		zr, err := zlib.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		r = zr
+	}
+	if conn.ctx.TransferType == "A" {
+		r = newASCIIReader(r)
+	}
+	return r, nil
+}
+
+// modeZMaxLevel returns the highest compression level allowed by the server
+func modeZMaxLevel() int {
+	max := globalServerSettings.ModeZMaxLevel
+	if max <= 0 || max > zlib.BestCompression {
+		return zlib.BestCompression
+	}
+	return max
+}
+
+// modeZLevel returns the compression level requested with OPTS MODE Z, capped by the server
+func (conn *ftpConnection) modeZLevel() int {
+	level := conn.zlibLevel
+	if level == zlib.DefaultCompression {
+		// zlib's default level is 6
+		level = 6
+	}
+	if max := modeZMaxLevel(); level > max {
+		return max
+	}
+	return level
+}
@@ -0,0 +1,196 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"log"
+	"path"
+	"strings"
+	"time"
+)
+
+// UploadHashStore selects where the SHA-256 hash computed while storing a file is recorded
+type UploadHashStore int
+
+const (
+	// UploadHashNone only reports the hash in the upload-complete event
+	UploadHashNone UploadHashStore = iota
+	// UploadHashSidecar writes the hash to a "<file>.sha256" file in `sha256sum` format
+	UploadHashSidecar
+	// UploadHashXattr sets the "user.sha256" extended attribute, where the storage supports it
+	UploadHashXattr
+)
+
+// errHashMismatch is returned when a stored file does not match the hash asserted with SITE VERIFY
+var errHashMismatch = errors.New("uploaded file does not match the expected hash")
+
+// takeExpectedHash returns the hash asserted with SITE VERIFY for this upload and clears it
+func (conn *ftpConnection) takeExpectedHash() string {
+	expected := conn.expectedHash
+	conn.expectedHash = ""
+	return expected
+}
+
+// createUpload creates the file receiving an upload to `filePath` from `offset`, and the hash
+// covering the whole file once the upload is done. Uploads checked against a hash asserted
+// with SITE VERIFY are written under a temporary name in the same directory, starting with
+// the contents kept before the offset, so that the file is only replaced once it matches.
+func (conn *ftpConnection) createUpload(filePath string, offset int64, verified bool) (string, io.WriteCloser, hash.Hash, error) {
+	uploadPath := filePath
+	if verified {
+		uploadPath = path.Join(path.Dir(filePath), "."+path.Base(filePath)+"."+conn.ctx.SessionID+".upload")
+	}
+	h := sha256.New()
+	var kept io.Writer = h
+	var file io.WriteCloser
+	if verified {
+		var err error
+		if file, err = conn.storage().Create(uploadPath, 0); err != nil {
+			return "", nil, nil, err
+		}
+		kept = io.MultiWriter(file, h)
+	}
+	if offset > 0 {
+		if err := conn.copyPrefix(filePath, offset, kept); err != nil {
+			if file != nil {
+				file.Close()
+				conn.storage().Remove(uploadPath)
+			}
+			return "", nil, nil, err
+		}
+	}
+	if file == nil {
+		var err error
+		if file, err = conn.storage().Create(filePath, offset); err != nil {
+			return "", nil, nil, err
+		}
+	}
+	return uploadPath, file, h, nil
+}
+
+// copyPrefix copies the first `size` bytes of a file
+func (conn *ftpConnection) copyPrefix(filePath string, size int64, dst io.Writer) error {
+	file, err := conn.storage().Open(filePath, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = io.CopyN(dst, file, size)
+	return err
+}
+
+// discardUpload removes the temporary file of a failed upload checked against a hash
+func (conn *ftpConnection) discardUpload(filePath string, uploadPath string) {
+	if uploadPath != filePath {
+		conn.storage().Remove(uploadPath)
+	}
+}
+
+// completeUpload checks a stored file against the hash asserted with SITE VERIFY, moving it
+// to quarantine on mismatch or in place of `filePath` otherwise, then records its hash and
+// reports the upload
+func (conn *ftpConnection) completeUpload(filePath string, uploadPath string, size int64, sum []byte, expected string) error {
+	hexSum := hex.EncodeToString(sum)
+	if expected != "" && expected != hexSum {
+		quarantinePath, err := conn.quarantine(filePath, uploadPath)
+		if err != nil {
+			conn.discardUpload(filePath, uploadPath)
+			log.Println("Failed to quarantine " + filePath + ": " + err.Error())
+		}
+		emitEvent(Event{
+			Kind:     EventUploadQuarantined,
+			RemoteIP: conn.remoteIP(),
+			User:     conn.loginUser,
+			Message:  "Upload of " + filePath + " does not match the expected hash, moved to " + quarantinePath,
+			Path:     filePath,
+			Size:     size,
+			Hash:     hexSum,
+			Session:  conn.ctx,
+		})
+		return errHashMismatch
+	}
+	if uploadPath != filePath {
+		if err := conn.storage().Rename(uploadPath, filePath); err != nil {
+			conn.discardUpload(filePath, uploadPath)
+			return err
+		}
+	}
+	if err := conn.recordUploadHash(filePath, hexSum); err != nil {
+		log.Println("Failed to record the hash of " + filePath + ": " + err.Error())
+	}
+	emitEvent(Event{
+		Kind:     EventUploadComplete,
+		RemoteIP: conn.remoteIP(),
+		User:     conn.loginUser,
+		Message:  "Stored " + filePath,
+		Path:     filePath,
+		Size:     size,
+		Hash:     hexSum,
+		Session:  conn.ctx,
+	})
+	return nil
+}
+
+// recordUploadHash records the hash of a stored file as configured by ServerSettings.UploadHashStore
+func (conn *ftpConnection) recordUploadHash(filePath string, hexSum string) error {
+	switch globalServerSettings.UploadHashStore {
+	case UploadHashSidecar:
+		// Sidecar files are not themselves given sidecars
+		if strings.HasSuffix(filePath, ".sha256") {
+			return nil
+		}
+		sidecar, err := conn.storage().Create(filePath+".sha256", 0)
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(sidecar, hexSum+"  "+path.Base(filePath)+"\n"); err != nil {
+			sidecar.Close()
+			return err
+		}
+		return sidecar.Close()
+	case UploadHashXattr:
+		storage, ok := conn.storage().(XattrStorage)
+		if !ok {
+			return errors.New("storage does not support extended attributes")
+		}
+		return storage.SetXattr(filePath, "user.sha256", []byte(hexSum))
+	}
+	return nil
+}
+
+// quarantineDirectory is the default quarantine directory, created in the upload directory
+const quarantineDirectory = ".quarantine"
+
+// inQuarantine reports whether `filePath` is in a quarantine directory
+func inQuarantine(filePath string) bool {
+	filePath = path.Clean("/" + filePath)
+	if dir := globalServerSettings.QuarantineDirectory; dir != "" {
+		dir = path.Clean(dir)
+		return filePath == dir || strings.HasPrefix(filePath, dir+"/")
+	}
+	for _, element := range strings.Split(filePath, "/") {
+		if element == quarantineDirectory {
+			return true
+		}
+	}
+	return false
+}
+
+// quarantine moves a rejected upload to `filePath`, written to `uploadPath`, to the quarantine
+// directory under a timestamped name
+func (conn *ftpConnection) quarantine(filePath string, uploadPath string) (string, error) {
+	dir := globalServerSettings.QuarantineDirectory
+	if dir == "" {
+		dir = path.Join(path.Dir(filePath), quarantineDirectory)
+	}
+	if info, err := conn.storage().Stat(dir); err != nil || !info.IsDir() {
+		if err := conn.storage().Mkdir(dir); err != nil {
+			return "", err
+		}
+	}
+	quarantinePath := path.Join(dir, path.Base(filePath)+"."+time.Now().UTC().Format(ftpTimeFormat))
+	return quarantinePath, conn.storage().Rename(uploadPath, quarantinePath)
+}
@@ -1,14 +1,141 @@
 package server
 
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
 // UserContext encapsulates information about the connecting user
 type UserContext struct {
 	User string // Username of connecting user
 	CWD  string // Current working directory of connecting user
+
+	Groups      []string // Groups of the user, selecting the "@group" access control rules
+	Permissions []string // Access control rules granted to this connection alone
+
+	PeerCertificates []*x509.Certificate // Verified TLS client certificate chain, leaf first
+
+	SessionID      string               // Unique identifier of the control connection
+	RemoteAddr     net.Addr             // User end of the control connection
+	LocalAddr      net.Addr             // Server end of the control connection
+	ConnectTime    time.Time            // When the control connection was accepted
+	TLSState       *tls.ConnectionState // State of the TLS control connection, nil if not TLS
+	ClientSoftware string               // Client software name sent with CLNT
+	TransferType   string               // Data representation set with TYPE ("A" or "I")
+	TransferMode   string               // Transmission mode set with MODE ("S", "B" or "Z")
+	Protection     string               // Data channel protection level set with PROT ("C" or "P")
+	UTF8           bool                 // Whether UTF-8 paths were enabled with OPTS UTF8 ON
+	HashAlgorithm  string               // Algorithm used by HASH, selected with OPTS HASH
+
+	sessionBuckets *bucketPair    // Transfer rate limits of this connection alone
+	transfers      *TransferStats // Transfer counters of this connection
+	values         *sessionValues // Driver-owned key/value store
+}
+
+// TransferStats counts the data transferred by a connection
+type TransferStats struct {
+	FilesUploaded   int64
+	FilesDownloaded int64
+	BytesUploaded   int64
+	BytesDownloaded int64
+}
+
+// sessionValues is a key/value store shared by the UserContexts of one connection
+type sessionValues struct {
+	lock   sync.RWMutex
+	values map[string]interface{}
 }
 
 // newUserContext creates a default UserContext
 func newUserContext() *UserContext {
 	return &UserContext{
-		CWD: globalServerSettings.PublicDirectory,
+		CWD:            globalServerSettings.PublicDirectory,
+		TransferType:   "A",
+		TransferMode:   "S",
+		Protection:     "C",
+		HashAlgorithm:  defaultHashAlgorithm,
+		sessionBuckets: newBucketPair(globalServerSettings.SessionRateLimits),
+		transfers:      &TransferStats{},
+		values:         &sessionValues{values: make(map[string]interface{})},
+	}
+}
+
+// newSessionID returns a random identifier for a new connection
+func newSessionID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// reinitialize returns a default UserContext for the same connection, as after a REIN
+// command. Properties of the connection itself and the driver-owned values are kept.
+func (ctx *UserContext) reinitialize() *UserContext {
+	fresh := newUserContext()
+	fresh.PeerCertificates = ctx.PeerCertificates
+	fresh.SessionID = ctx.SessionID
+	fresh.RemoteAddr = ctx.RemoteAddr
+	fresh.LocalAddr = ctx.LocalAddr
+	fresh.ConnectTime = ctx.ConnectTime
+	fresh.TLSState = ctx.TLSState
+	fresh.ClientSoftware = ctx.ClientSoftware
+	fresh.UTF8 = ctx.UTF8
+	fresh.sessionBuckets = ctx.sessionBuckets
+	fresh.transfers = ctx.transfers
+	fresh.values = ctx.values
+	return fresh
+}
+
+// Transfers returns a snapshot of the transfer counters of the connection
+func (ctx *UserContext) Transfers() TransferStats {
+	return TransferStats{
+		FilesUploaded:   atomic.LoadInt64(&ctx.transfers.FilesUploaded),
+		FilesDownloaded: atomic.LoadInt64(&ctx.transfers.FilesDownloaded),
+		BytesUploaded:   atomic.LoadInt64(&ctx.transfers.BytesUploaded),
+		BytesDownloaded: atomic.LoadInt64(&ctx.transfers.BytesDownloaded),
+	}
+}
+
+// countUpload adds a completed (or partial, when `complete` is false) upload to the counters
+func (ctx *UserContext) countUpload(bytes int64, complete bool) {
+	atomic.AddInt64(&ctx.transfers.BytesUploaded, bytes)
+	if complete {
+		atomic.AddInt64(&ctx.transfers.FilesUploaded, 1)
+	}
+}
+
+// countDownload adds a completed (or partial, when `complete` is false) download to the counters
+func (ctx *UserContext) countDownload(bytes int64, complete bool) {
+	atomic.AddInt64(&ctx.transfers.BytesDownloaded, bytes)
+	if complete {
+		atomic.AddInt64(&ctx.transfers.FilesDownloaded, 1)
 	}
 }
+
+// Set stores a driver-owned value (e.g. a database handle or tenant ID) for the lifetime
+// of the connection
+func (ctx *UserContext) Set(key string, value interface{}) {
+	ctx.values.lock.Lock()
+	ctx.values.values[key] = value
+	ctx.values.lock.Unlock()
+}
+
+// Get returns a value stored with Set
+func (ctx *UserContext) Get(key string) (interface{}, bool) {
+	ctx.values.lock.RLock()
+	defer ctx.values.lock.RUnlock()
+	value, ok := ctx.values.values[key]
+	return value, ok
+}
+
+// Delete removes a value stored with Set
+func (ctx *UserContext) Delete(key string) {
+	ctx.values.lock.Lock()
+	delete(ctx.values.values, key)
+	ctx.values.lock.Unlock()
+}
@@ -0,0 +1,11 @@
+//go:build linux
+// +build linux
+
+package server
+
+import "syscall"
+
+// setXattr sets an extended attribute of a file
+func setXattr(path string, name string, value []byte) error {
+	return syscall.Setxattr(path, name, value, 0)
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package server
+
+import "errors"
+
+// setXattr sets an extended attribute of a file, which is not supported on this platform
+func setXattr(path string, name string, value []byte) error {
+	return errors.New("extended attributes are not supported on this platform")
+}